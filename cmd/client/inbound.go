@@ -1,8 +1,10 @@
 package main
 
 import (
+	"anytls/proxy/session"
 	std_bufio "bufio"
 	"context"
+	"errors"
 	"net"
 	"runtime/debug"
 
@@ -54,17 +56,37 @@ func (c *myClient) NewConnection(ctx context.Context, conn net.Conn, metadata M.
 	}
 	defer proxyC.Close()
 
+	// 服务器的出站连接被 RST 时，本地入站连接也以 RST 关闭，反之亦然
+	if stream, ok := proxyC.(*session.ClientStream); ok {
+		conn = session.NewResetConn(conn, stream)
+	}
+
 	return bufio.CopyConn(ctx, conn, proxyC)
 }
 
 func (c *myClient) NewPacketConnection(ctx context.Context, conn network.PacketConn, metadata M.Metadata) error {
-	proxyC, err := c.CreateProxy(ctx, uot.RequestDestination(2))
+	proxyC, err := c.sessionClient.CreateStream(ctx)
 	if err != nil {
-		logrus.Errorln("CreateProxy:", err)
+		logrus.Errorln("CreateStream:", err)
 		return err
 	}
 	defer proxyC.Close()
 
+	// 服务器支持时使用原生数据报，否则退回 UoT
+	if stream, ok := proxyC.(*session.ClientStream); ok {
+		packetConn, err := session.OpenPacketConn(ctx, stream.Stream())
+		if err == nil {
+			return bufio.CopyPacketConn(ctx, conn, packetConn)
+		} else if !errors.Is(err, session.ErrDatagramUnsupported) {
+			return err
+		}
+	}
+
+	err = M.SocksaddrSerializer.WriteAddrPort(proxyC, uot.RequestDestination(2))
+	if err != nil {
+		return err
+	}
+
 	request := uot.Request{
 		Destination: metadata.Destination,
 	}
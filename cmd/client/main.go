@@ -2,6 +2,7 @@ package main
 
 import (
 	"anytls/proxy"
+	"anytls/proxy/session"
 	"anytls/util"
 	"context"
 	"crypto/sha256"
@@ -10,6 +11,7 @@ import (
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -28,6 +30,18 @@ func main() {
 	serverAddr := flag.String("s", "127.0.0.1:8443", "server address")
 	sni := flag.String("sni", "", "SNI")
 	password := flag.String("p", "", "password")
+	heartbeatInterval := flag.Duration("heartbeat-interval", time.Second*30, "send keepalive requests on sessions idle for this long (0 to disable)")
+	heartbeatMaxMissed := flag.Int("heartbeat-max-missed", 3, "close a session after this many unanswered keepalive requests")
+	idleProbeAfter := flag.Duration("idle-probe-after", time.Second*15, "ping an idle session before reuse if nothing was received on it for this long (0 to disable)")
+	idleMaxAge := flag.Duration("idle-max-age", 0, "dial a new session instead of reusing one that has been idle for this long (0 to disable)")
+	sessionMaxLifetime := flag.Duration("session-max-lifetime", 0, "stop opening streams on a session this long after it was dialed (0 to disable)")
+	sessionLifetimeJitter := flag.Duration("session-lifetime-jitter", 0, "random extra lifetime added per session, up to this long")
+	sessionMaxStreams := flag.Uint("session-max-streams", 0, "stop opening streams on a session after this many streams (0 to disable)")
+	sessionMaxBytes := flag.Uint64("session-max-bytes", 0, "stop opening streams on a session after it carried this many bytes (0 to disable)")
+	maxFrameSize := flag.Int("max-frame-size", 0, "largest data frame payload in bytes, 1024-65535 (default: 16377, one TLS record)")
+	serverPaddingMd5 := flag.String("server-padding-md5", "", "warn if the server pads downstream traffic with a scheme of another md5")
+	paddingFile := flag.String("padding-file", "", "save the padding scheme pushed by the server to this file and load it on start")
+	authVersion := flag.Int("auth-version", 1, "authentication version, 2 binds the request to the TLS connection but needs a server that supports it")
 	flag.Parse()
 
 	if *password == "" {
@@ -76,6 +90,25 @@ func main() {
 		}
 		conn = tls.Client(conn, tlsConfig)
 		return conn, nil
+	}, myClientConfig{
+		Heartbeat: session.HeartbeatConfig{
+			Interval:  *heartbeatInterval,
+			MaxMissed: *heartbeatMaxMissed,
+		},
+		IdlePolicy: session.IdlePolicy{
+			ProbeAfter: *idleProbeAfter,
+			MaxIdleAge: *idleMaxAge,
+		},
+		Rotation: session.RotationPolicy{
+			MaxLifetime:    *sessionMaxLifetime,
+			LifetimeJitter: *sessionLifetimeJitter,
+			MaxStreams:     uint32(*sessionMaxStreams),
+			MaxBytes:       *sessionMaxBytes,
+		},
+		MaxFrameSize:        *maxFrameSize,
+		ExpectServerPadding: *serverPaddingMd5,
+		PaddingFile:         *paddingFile,
+		AuthVersion:         *authVersion,
 	})
 
 	for {
@@ -1,28 +1,61 @@
 package main
 
 import (
+	"anytls/proxy/auth"
 	"anytls/proxy/padding"
 	"anytls/proxy/session"
 	"anytls/util"
 	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"net"
 	"time"
 
 	"github.com/sagernet/sing/common/buf"
 	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sirupsen/logrus"
 )
 
 type myClient struct {
 	dialOut       util.DialOutFunc
 	sessionClient *session.Client
+	// 认证版本，1 为静态 sha256(password)
+	authVersion int
 }
 
-func NewMyClient(ctx context.Context, dialOut util.DialOutFunc) *myClient {
+// myClientConfig 是 NewMyClient 的选项，零值表示使用默认行为
+type myClientConfig struct {
+	Heartbeat  session.HeartbeatConfig
+	IdlePolicy session.IdlePolicy
+	Rotation   session.RotationPolicy
+	// 最大数据帧长度，0 为默认值
+	MaxFrameSize int
+	// 期望的服务器下行填充方案 md5，为空则不检查
+	ExpectServerPadding string
+	// 保存服务器下发的填充方案的文件，为空则不保存
+	PaddingFile string
+	// 认证版本，1 为静态 sha256(password)
+	AuthVersion int
+}
+
+func NewMyClient(ctx context.Context, dialOut util.DialOutFunc, config myClientConfig) *myClient {
 	s := &myClient{
-		dialOut: dialOut,
+		dialOut:     dialOut,
+		authVersion: config.AuthVersion,
 	}
+	// session.Client 持有填充方案的副本，服务器下发的方案只更新副本
 	s.sessionClient = session.NewClient(ctx, s.createOutboundConnection, &padding.DefaultPaddingFactory, time.Second*30, time.Second*30, 5)
+	s.sessionClient.SetHeartbeat(config.Heartbeat)
+	s.sessionClient.SetIdlePolicy(config.IdlePolicy)
+	s.sessionClient.SetRotationPolicy(config.Rotation)
+	s.sessionClient.SetMaxFrameSize(config.MaxFrameSize)
+	s.sessionClient.ExpectServerPadding(config.ExpectServerPadding)
+	if config.PaddingFile != "" {
+		if err := s.sessionClient.SetPaddingFile(config.PaddingFile); err != nil {
+			logrus.Warnln("load padding file:", err)
+		}
+	}
 	return s
 }
 
@@ -48,9 +81,28 @@ func (c *myClient) createOutboundConnection(ctx context.Context) (net.Conn, erro
 	b := buf.NewPacket()
 	defer b.Release()
 
-	b.Write(passwordSha256)
+	if c.authVersion >= 2 {
+		// v2 认证绑定到本次 TLS 连接，需要先完成握手
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok {
+			conn.Close()
+			return nil, errors.New("auth v2 needs a TLS connection")
+		}
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		exporter, err := auth.Exporter(tlsConn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		b.Write(auth.NewRequestV2(passwordSha256, exporter, time.Now()))
+	} else {
+		b.Write(passwordSha256)
+	}
 	var paddingLen int
-	if pad := padding.DefaultPaddingFactory.Load().GenerateRecordPayloadSizes(0); len(pad) > 0 {
+	if pad := c.sessionClient.Padding().GenerateRecordPayloadSizes(0); len(pad) > 0 {
 		paddingLen = pad[0]
 	}
 	binary.BigEndian.PutUint16(b.Extend(2), uint16(paddingLen))
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeIssuer 通过 ACME 为配置的域名签发证书，使用 TLS-ALPN-01 在同一个监听端口上完成验证，
+// 证书保存在缓存目录中，到期前自动续期
+type acmeIssuer struct {
+	manager *autocert.Manager
+	domains []string
+}
+
+// acmeConfig 是 -acme-* 参数
+type acmeConfig struct {
+	domains      string // 逗号分隔
+	email        string
+	cacheDir     string
+	directoryURL string // 默认为 Let's Encrypt
+	caRoot       string // 访问 ACME 服务器时额外信任的根证书，例如 Pebble 的
+	renewBefore  time.Duration
+}
+
+func newACMEIssuer(config acmeConfig) (*acmeIssuer, error) {
+	domains := splitList(config.domains)
+	if len(domains) == 0 {
+		return nil, errors.New("no ACME domains")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.caRoot != "" {
+		pem, err := os.ReadFile(config.caRoot)
+		if err != nil {
+			return nil, err
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New(config.caRoot + ": no certificate found")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	client := &acme.Client{
+		DirectoryURL: config.directoryURL,
+		HTTPClient: &http.Client{Transport: &orderLocationTransport{
+			base:   transport,
+			orders: make(map[string]string),
+		}},
+	}
+	return &acmeIssuer{
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(config.cacheDir),
+			HostPolicy:  autocert.HostWhitelist(domains...),
+			RenewBefore: config.renewBefore,
+			Client:      client,
+			Email:       config.email,
+		},
+		domains: domains,
+	}, nil
+}
+
+// isChallenge 判断是否为 ACME 服务器的 TLS-ALPN-01 验证连接
+func isChallenge(hello *tls.ClientHelloInfo) bool {
+	return slices.Contains(hello.SupportedProtos, acme.ALPNProto)
+}
+
+// configure 让验证连接协商 acme-tls/1，其他连接的 ALPN 不受影响
+func (a *acmeIssuer) configure(tlsConfig *tls.Config) {
+	challengeConfig := &tls.Config{
+		GetCertificate: a.manager.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	}
+	tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if isChallenge(hello) {
+			return challengeConfig, nil
+		}
+		return nil, nil
+	}
+}
+
+// getCertificate 返回 ACME 证书。SNI 不是配置的域名（或没有 SNI）时使用第一个域名的证书
+func (a *acmeIssuer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if !slices.Contains(a.domains, strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))) {
+		h := *hello
+		h.ServerName = a.domains[0]
+		hello = &h
+	}
+	return a.manager.GetCertificate(hello)
+}
+
+// prefetch 在启动时为每个域名读取或申请证书，不必等到第一个客户端连接，
+// 之后 autocert 会在证书到期前 RenewBefore 自动续期
+func (a *acmeIssuer) prefetch(ctx context.Context) {
+	for _, domain := range a.domains {
+		cert, err := a.manager.GetCertificate(&tls.ClientHelloInfo{
+			ServerName:       domain,
+			CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logrus.Errorln("[Server] ACME certificate for", domain, "failed:", err)
+			continue
+		}
+		logrus.Infof("[Server] ACME certificate for %s valid until %s", domain, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// orderLocationTransport 补上 finalize 响应缺少的 Location 头。RFC 8555 不要求该响应带有 Location，
+// 但 x/crypto/acme 要用它等待异步签发的证书（例如 Pebble），这里按新建订单时记录的 finalize URL 找回订单 URL
+type orderLocationTransport struct {
+	base http.RoundTripper
+
+	lock   sync.Mutex
+	orders map[string]string // finalize URL -> 订单 URL
+}
+
+func (t *orderLocationTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost {
+		return resp, err
+	}
+	finalizeURL := req.URL.String()
+	if location := resp.Header.Get("Location"); location != "" {
+		if resp.StatusCode != http.StatusCreated {
+			return resp, nil
+		}
+		// 新建的订单（或账户），记录订单的 finalize URL
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		var order struct {
+			Finalize string `json:"finalize"`
+		}
+		if json.Unmarshal(body, &order) == nil && order.Finalize != "" {
+			t.lock.Lock()
+			t.orders[order.Finalize] = location
+			t.lock.Unlock()
+		}
+		return resp, nil
+	}
+	t.lock.Lock()
+	location, ok := t.orders[finalizeURL]
+	delete(t.orders, finalizeURL)
+	t.lock.Unlock()
+	if ok {
+		resp.Header.Set("Location", location)
+	}
+	return resp, nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"anytls/util"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// selfSignedRenewBefore 自签证书只有一小时有效期，在到期前这么久重新生成
+const selfSignedRenewBefore = 10 * time.Minute
+
+// certFile 是一组证书与私钥文件，文件修改后重新加载
+type certFile struct {
+	certPath string
+	keyPath  string
+
+	certModTime time.Time
+	keyModTime  time.Time
+	cert        *tls.Certificate
+	warned      time.Time // 上次输出到期警告的时间
+}
+
+// certStore 为 GetCertificate 提供证书：配置了 ACME 时优先使用 ACME 证书；
+// 否则按 SNI 在证书文件中选择，都不匹配时使用第一个；没有证书文件时使用自签证书
+type certStore struct {
+	acme        *acmeIssuer
+	files       []*certFile
+	warnBefore  time.Duration
+	selfSignSNI string
+
+	lock  sync.RWMutex
+	certs []*tls.Certificate
+}
+
+// newCertStore 加载证书，certPaths 与 keyPaths 为逗号分隔、一一对应的文件列表
+func newCertStore(certPaths, keyPaths string, selfSignSNI string, warnBefore time.Duration) (*certStore, error) {
+	s := &certStore{
+		warnBefore:  warnBefore,
+		selfSignSNI: selfSignSNI,
+	}
+	certList := splitList(certPaths)
+	keyList := splitList(keyPaths)
+	if len(certList) != len(keyList) {
+		return nil, fmt.Errorf("%d certificate files but %d key files", len(certList), len(keyList))
+	}
+	for i := range certList {
+		s.files = append(s.files, &certFile{certPath: certList[i], keyPath: keyList[i]})
+	}
+	if len(s.files) == 0 {
+		cert, err := util.GenerateKeyPair(time.Now, selfSignSNI)
+		if err != nil {
+			return nil, err
+		}
+		s.certs = []*tls.Certificate{cert}
+		return s, nil
+	}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// GetCertificate 选择 ACME 证书或第一个与 ClientHello 匹配（域名、签名算法）的证书
+func (s *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if s.acme != nil {
+		cert, err := s.acme.getCertificate(hello)
+		if err == nil {
+			return cert, nil
+		}
+		// 证书还没有签发下来时，客户端仍然可以使用证书文件或自签证书连接
+		logrus.Debugln("[Server] ACME certificate:", err)
+	}
+	if len(s.files) == 0 {
+		return s.selfSigned()
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, cert := range s.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return s.certs[0], nil
+}
+
+// selfSigned 返回自签证书，快到期时重新生成
+func (s *certStore) selfSigned() (*tls.Certificate, error) {
+	s.lock.RLock()
+	cert := s.certs[0]
+	s.lock.RUnlock()
+	if time.Now().Before(cert.Leaf.NotAfter.Add(-selfSignedRenewBefore)) {
+		return cert, nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if cert = s.certs[0]; time.Now().Before(cert.Leaf.NotAfter.Add(-selfSignedRenewBefore)) {
+		return cert, nil
+	}
+	cert, err := util.GenerateKeyPair(time.Now, s.selfSignSNI)
+	if err != nil {
+		// 继续使用旧证书，下次握手再试
+		logrus.Errorln("[Server] Failed to renew self-signed certificate:", err)
+		return s.certs[0], nil
+	}
+	s.certs[0] = cert
+	logrus.Debugln("[Server] Renewed self-signed certificate for", s.selfSignSNI)
+	return cert, nil
+}
+
+// reload 重新加载修改过的证书文件，加载失败时保留原有证书，下次再试。
+// 只在第一次加载时返回错误，之后的错误只输出日志。
+func (s *certStore) reload() (bool, error) {
+	first := s.certs == nil
+	var changed bool
+	certs := make([]*tls.Certificate, len(s.files))
+	for i, f := range s.files {
+		updated, err := f.load()
+		if err != nil {
+			if first {
+				return false, err
+			}
+			logrus.Errorln("[Server] Failed to reload certificate:", err)
+		} else if updated {
+			changed = true
+			logrus.Infoln("[Server] Loaded certificate:", f.certPath, strings.Join(f.cert.Leaf.DNSNames, ","))
+		}
+		certs[i] = f.cert
+	}
+	if changed {
+		s.lock.Lock()
+		s.certs = certs
+		s.lock.Unlock()
+	}
+	s.checkExpiry(time.Now())
+	return changed, nil
+}
+
+func (f *certFile) load() (bool, error) {
+	certInfo, err := os.Stat(f.certPath)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(f.keyPath)
+	if err != nil {
+		return false, err
+	}
+	if certInfo.ModTime().Equal(f.certModTime) && keyInfo.ModTime().Equal(f.keyModTime) {
+		return false, nil
+	}
+	// 证书与私钥不是同时写入时会暂时不匹配，保留原有证书
+	cert, err := tls.LoadX509KeyPair(f.certPath, f.keyPath)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", f.certPath, err)
+	}
+	if cert.Leaf == nil {
+		return false, fmt.Errorf("%s: %w", f.certPath, errors.New("no certificate"))
+	}
+	f.cert = &cert
+	f.certModTime = certInfo.ModTime()
+	f.keyModTime = keyInfo.ModTime()
+	f.warned = time.Time{}
+	return true, nil
+}
+
+// checkExpiry 在证书到期前 warnBefore 开始每天输出一次警告
+func (s *certStore) checkExpiry(now time.Time) {
+	for _, f := range s.files {
+		if f.cert == nil || now.Sub(f.warned) < 24*time.Hour {
+			continue
+		}
+		notAfter := f.cert.Leaf.NotAfter
+		if remaining := notAfter.Sub(now); remaining <= 0 {
+			logrus.Errorf("[Server] Certificate %s expired at %s", f.certPath, notAfter.Format(time.RFC3339))
+		} else if remaining <= s.warnBefore {
+			logrus.Warnf("[Server] Certificate %s expires in %s at %s", f.certPath, remaining.Round(time.Hour), notAfter.Format(time.RFC3339))
+		} else {
+			continue
+		}
+		f.warned = now
+	}
+}
+
+// watch 定期检查证书文件，由 util.StartRoutine 调用
+func (s *certStore) watch() {
+	if len(s.files) > 0 {
+		s.reload()
+	}
+}
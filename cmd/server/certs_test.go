@@ -0,0 +1,161 @@
+package main
+
+import (
+	"anytls/util"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertFiles 为 serverName 生成证书并写入 name.crt 与 name.key，修改时间每次都往后推
+func writeCertFiles(t *testing.T, dir, name, serverName string) (certPath, keyPath string) {
+	t.Helper()
+	cert, err := util.GenerateKeyPair(time.Now, serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writeFileLater(t, certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}))
+	writeFileLater(t, keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}))
+	return
+}
+
+// handshakeCert 以 serverName 完成 TLS 握手，返回服务器出示的证书
+func handshakeCert(t *testing.T, s *certStore, serverName string) *x509.Certificate {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go tls.Server(c2, &tls.Config{GetCertificate: s.GetCertificate}).Handshake()
+	conn := tls.Client(c1, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestCertStoreSNI(t *testing.T) {
+	dir := t.TempDir()
+	certA, keyA := writeCertFiles(t, dir, "a", "a.example.com")
+	certB, keyB := writeCertFiles(t, dir, "b", "b.example.com")
+	s, err := newCertStore(certA+","+certB, keyA+", "+keyB, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for serverName, want := range map[string]string{
+		"a.example.com": "a.example.com",
+		"b.example.com": "b.example.com",
+		"c.example.com": "a.example.com", // 都不匹配时使用第一个
+		"":              "a.example.com",
+	} {
+		if got := handshakeCert(t, s, serverName).DNSNames[0]; got != want {
+			t.Errorf("sni %q got %s", serverName, got)
+		}
+	}
+
+	if _, err = newCertStore(certA+","+certB, keyA, "", 0); err == nil {
+		t.Error("loaded two certificates with one key")
+	}
+	if _, err = newCertStore(certA, keyB, "", 0); err == nil {
+		t.Error("loaded a certificate with the key of another")
+	}
+}
+
+func TestCertStoreReload(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertFiles(t, dir, "a", "a.example.com")
+	s, err := newCertStore(certPath, keyPath, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := handshakeCert(t, s, "a.example.com")
+	if changed, err := s.reload(); changed || err != nil {
+		t.Fatal("reload of unchanged files", changed, err)
+	}
+
+	// 证书更新后，新的握手使用新证书
+	writeCertFiles(t, dir, "a", "a.example.com")
+	if changed, err := s.reload(); !changed || err != nil {
+		t.Fatal("reload", changed, err)
+	}
+	renewed := handshakeCert(t, s, "a.example.com")
+	if renewed.SerialNumber.Cmp(old.SerialNumber) == 0 {
+		t.Fatal("still the old certificate")
+	}
+
+	// 只写入了新证书、私钥还是旧的时，保留原有证书，等私钥写入后再加载
+	other, _ := writeCertFiles(t, t.TempDir(), "b", "a.example.com")
+	b, _ := os.ReadFile(other)
+	writeFileLater(t, certPath, b)
+	if changed, err := s.reload(); changed || err != nil {
+		t.Fatal("reload of a mismatched pair", changed, err)
+	}
+	if got := handshakeCert(t, s, "a.example.com"); got.SerialNumber.Cmp(renewed.SerialNumber) != 0 {
+		t.Fatal("certificate replaced by a mismatched pair")
+	}
+	writeCertFiles(t, dir, "a", "a.example.com")
+	if changed, err := s.reload(); !changed || err != nil {
+		t.Fatal("reload after the key was written", changed, err)
+	}
+}
+
+func TestCertStoreExpiry(t *testing.T) {
+	dir := t.TempDir()
+	// 生成的证书一小时后到期
+	certPath, keyPath := writeCertFiles(t, dir, "a", "a.example.com")
+	s, err := newCertStore(certPath, keyPath, "", 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warned := s.files[0].warned
+	if warned.IsZero() {
+		t.Fatal("no warning for a certificate about to expire")
+	}
+	// 每天只警告一次
+	s.checkExpiry(warned.Add(time.Hour))
+	if s.files[0].warned != warned {
+		t.Fatal("warned again within a day")
+	}
+	s.checkExpiry(warned.Add(25 * time.Hour))
+	if s.files[0].warned == warned {
+		t.Fatal("no warning on the next day")
+	}
+
+	s, err = newCertStore(certPath, keyPath, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.files[0].warned.IsZero() {
+		t.Fatal("warned long before the expiry")
+	}
+}
+
+func TestCertStoreSelfSigned(t *testing.T) {
+	s, err := newCertStore("", "", "self.example.com", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := handshakeCert(t, s, "anything")
+	if first.DNSNames[0] != "self.example.com" {
+		t.Fatal("self-signed for", first.DNSNames)
+	}
+	// 快到期时重新生成
+	expiring, err := util.GenerateKeyPair(func() time.Time { return time.Now().Add(-55 * time.Minute) }, "self.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.certs[0] = expiring
+	renewed := handshakeCert(t, s, "anything")
+	if renewed.SerialNumber.Cmp(expiring.Leaf.SerialNumber) == 0 || renewed.SerialNumber.Cmp(first.SerialNumber) == 0 {
+		t.Fatal("self-signed certificate not renewed")
+	}
+}
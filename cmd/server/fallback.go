@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+)
+
+const fallbackDialTimeout = 5 * time.Second
+
+// fallbackHandler 接管认证失败的连接。c 为 bufio.CachedConn，先读出的是已经读取的首个数据包，
+// 因此处理者看到的字节与客户端发送的完全一致。
+type fallbackHandler interface {
+	serve(ctx context.Context, c net.Conn)
+	String() string
+}
+
+// parseFallback 解析 -fallback 参数：
+//   - `host:port`、`tcp://host:port` 或 `unix:/path/to/socket`：原样转发给后端
+//   - `static:/var/www`：内置的静态网站
+//   - `http://127.0.0.1:8080`：内置的反向代理
+func parseFallback(s string, serverHeader string) (fallbackHandler, error) {
+	if root, ok := strings.CutPrefix(s, "static:"); ok {
+		return newStaticSite(root, serverHeader)
+	}
+	if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+		return newProxySite(s, serverHeader)
+	}
+	if path, ok := strings.CutPrefix(s, "unix:"); ok {
+		path = strings.TrimPrefix(path, "//")
+		if path == "" {
+			return nil, &net.AddrError{Err: "missing unix socket path", Addr: s}
+		}
+		return &fallbackBackend{network: "unix", address: path}, nil
+	}
+	address := strings.TrimPrefix(s, "tcp://")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, err
+	}
+	return &fallbackBackend{network: "tcp", address: address}, nil
+}
+
+// fallback 处理认证失败的连接，没有配置 fallback 时直接关闭连接
+func fallback(ctx context.Context, c net.Conn, server *myServer) {
+	if server.fallback == nil {
+		logrus.Debugln("fallback:", c.RemoteAddr())
+		return
+	}
+	logrus.Debugln("fallback:", c.RemoteAddr(), "=>", server.fallback)
+	server.fallback.serve(ctx, c)
+}
+
+// fallbackBackend 将连接原样转发给后端，后端收到的是 TLS 解密后的明文
+type fallbackBackend struct {
+	network string // "tcp" 或 "unix"
+	address string
+}
+
+func (f *fallbackBackend) String() string {
+	return f.network + ":" + f.address
+}
+
+func (f *fallbackBackend) serve(ctx context.Context, c net.Conn) {
+	dialer := net.Dialer{Timeout: fallbackDialTimeout}
+	backend, err := dialer.DialContext(ctx, f.network, f.address)
+	if err != nil {
+		logrus.Warnln("fallback: dial", f, err)
+		return
+	}
+	defer backend.Close()
+
+	err = bufio.CopyConn(ctx, c, backend)
+	if err != nil {
+		logrus.Debugln("fallback:", c.RemoteAddr(), err)
+	}
+}
+
+// fallbackSite 是内置的 HTTP 网站，在已经终止的 TLS 连接上按 ALPN 提供 HTTP/1.1 或 HTTP/2，
+// 响应头与错误页面模仿 nginx 的默认配置
+type fallbackSite struct {
+	name         string
+	serverHeader string
+	handler      http.Handler
+	errorPages   fs.FS // 可选的 404.html 等自定义错误页面
+
+	http1 *http.Server
+	http2 *http2.Server
+}
+
+// fallbackNextProtos 是启用内置网站时服务器通告的 ALPN，与网站实际支持的协议一致
+var fallbackNextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+
+func newFallbackSite(name, serverHeader string, handler http.Handler) *fallbackSite {
+	f := &fallbackSite{
+		name:         name,
+		serverHeader: serverHeader,
+	}
+	f.handler = handler
+	f.http1 = &http.Server{
+		Handler:           f,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       75 * time.Second, // nginx keepalive_timeout
+		ErrorLog:          log.New(logrus.StandardLogger().WriterLevel(logrus.DebugLevel), "fallback: ", 0),
+	}
+	f.http2 = &http2.Server{
+		IdleTimeout: f.http1.IdleTimeout,
+	}
+	return f
+}
+
+// newStaticSite 提供目录中的静态文件，目录中的 404.html 等文件会替代默认的错误页面
+func newStaticSite(root string, serverHeader string) (*fallbackSite, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+	f := newFallbackSite("static:"+root, serverHeader, nil)
+	f.errorPages = os.DirFS(root)
+	f.handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.serveFile(w, r, http.Dir(root))
+	})
+	return f, nil
+}
+
+// newProxySite 将请求反向代理到上游，与 nginx 的 proxy_pass 一样改写 Host 并附加 X-Forwarded-* 请求头
+func newProxySite(upstream string, serverHeader string) (*fallbackSite, error) {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	if target.Host == "" {
+		return nil, fmt.Errorf("missing host in %s", upstream)
+	}
+	f := newFallbackSite(upstream, serverHeader, nil)
+	f.handler = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+			r.SetXForwarded()
+			// 客户端看到的是 HTTPS
+			r.Out.Header.Set("X-Forwarded-Proto", "https")
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			// 与 nginx 一样以自己的 Server 替换上游的
+			resp.Header.Del("Server")
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logrus.Debugln("fallback: upstream", upstream, err)
+			f.errorPage(w, r, http.StatusBadGateway)
+		},
+		ErrorLog: f.http1.ErrorLog,
+	}
+	return f, nil
+}
+
+func (f *fallbackSite) String() string {
+	return f.name
+}
+
+func (f *fallbackSite) serve(ctx context.Context, c net.Conn) {
+	if negotiatedProtocol(c) == http2.NextProtoTLS {
+		f.http2.ServeConn(c, &http2.ServeConnOpts{
+			Context:    ctx,
+			BaseConfig: f.http1,
+			Handler:    f,
+		})
+		return
+	}
+	l := newOneConnListener(c)
+	f.http1.Serve(l)
+	l.wait()
+}
+
+// ServeHTTP 加上通用的响应头并记录请求
+func (f *fallbackSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.serverHeader != "" {
+		w.Header().Set("Server", f.serverHeader)
+	}
+	f.handler.ServeHTTP(w, r)
+	logrus.Debugln("fallback:", r.RemoteAddr, r.Proto, r.Method, r.URL.Path)
+}
+
+// serveFile 与 nginx 的默认行为一致：目录需要以 / 结尾且包含 index.html，不列出目录内容，只接受 GET 与 HEAD
+func (f *fallbackSite) serveFile(w http.ResponseWriter, r *http.Request, root http.FileSystem) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		f.errorPage(w, r, http.StatusMethodNotAllowed)
+		return
+	}
+	name := path.Clean("/" + r.URL.Path)
+	// 不暴露 .git 之类的隐藏文件
+	if strings.Contains(name, "/.") {
+		f.errorPage(w, r, http.StatusNotFound)
+		return
+	}
+	file, err := root.Open(name)
+	if err != nil {
+		f.errorPage(w, r, fileErrorStatus(err))
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		f.errorPage(w, r, fileErrorStatus(err))
+		return
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := r.URL.Path + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		index, err := root.Open(path.Join(name, "index.html"))
+		if err != nil {
+			// autoindex off
+			f.errorPage(w, r, http.StatusForbidden)
+			return
+		}
+		defer index.Close()
+		if info, err = index.Stat(); err != nil || info.IsDir() {
+			f.errorPage(w, r, http.StatusForbidden)
+			return
+		}
+		file = index
+	}
+	// nginx 的 ETag 由修改时间与长度组成
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().Unix(), info.Size()))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+func fileErrorStatus(err error) int {
+	if errors.Is(err, fs.ErrPermission) {
+		return http.StatusForbidden
+	}
+	return http.StatusNotFound
+}
+
+// errorPage 优先使用网站目录中的 <状态码>.html，否则使用 nginx 样式的默认页面
+func (f *fallbackSite) errorPage(w http.ResponseWriter, r *http.Request, code int) {
+	var page []byte
+	if f.errorPages != nil {
+		page, _ = fs.ReadFile(f.errorPages, fmt.Sprintf("%d.html", code))
+	}
+	if page == nil {
+		status := fmt.Sprintf("%d %s", code, http.StatusText(code))
+		footer := ""
+		if f.serverHeader != "" {
+			footer = "<hr><center>" + f.serverHeader + "</center>\r\n"
+		}
+		page = []byte("<html>\r\n<head><title>" + status + "</title></head>\r\n<body>\r\n<center><h1>" + status + "</h1></center>\r\n" + footer + "</body>\r\n</html>\r\n")
+	}
+	if code == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", "GET, HEAD")
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Length", fmt.Sprint(len(page)))
+	w.WriteHeader(code)
+	if r.Method != http.MethodHead {
+		w.Write(page)
+	}
+}
+
+// negotiatedProtocol 返回连接 TLS 握手协商的 ALPN
+func negotiatedProtocol(c net.Conn) string {
+	for {
+		switch conn := c.(type) {
+		case *tls.Conn:
+			return conn.ConnectionState().NegotiatedProtocol
+		case *bufio.CachedConn:
+			c, _ = conn.Upstream().(net.Conn)
+		default:
+			return ""
+		}
+	}
+}
+
+// oneConnListener 让 http.Server 服务单个连接，wait 在连接关闭后返回
+type oneConnListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newOneConnListener(c net.Conn) *oneConnListener {
+	l := &oneConnListener{closed: make(chan struct{})}
+	l.conn = &notifyCloseConn{Conn: c, closed: l.closed}
+	return l
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	var c net.Conn
+	l.once.Do(func() {
+		c = l.conn
+	})
+	if c == nil {
+		return nil, io.EOF
+	}
+	return c, nil
+}
+
+func (l *oneConnListener) Close() error {
+	return nil
+}
+
+func (l *oneConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *oneConnListener) wait() {
+	<-l.closed
+}
+
+type notifyCloseConn struct {
+	net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *notifyCloseConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
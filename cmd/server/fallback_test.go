@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestParseFallback(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		s    string
+		want string // 为空时应解析失败
+	}{
+		{"127.0.0.1:8080", "tcp:127.0.0.1:8080"},
+		{"tcp://localhost:80", "tcp:localhost:80"},
+		{"unix:/run/nginx.sock", "unix:/run/nginx.sock"},
+		{"unix:///run/nginx.sock", "unix:/run/nginx.sock"},
+		{"static:" + dir, "static:" + dir},
+		{"http://127.0.0.1:8080", "http://127.0.0.1:8080"},
+		{"localhost", ""},
+		{"unix:", ""},
+		{"static:" + filepath.Join(dir, "missing"), ""},
+		{"http://", ""},
+	} {
+		f, err := parseFallback(c.s, "nginx")
+		if c.want == "" {
+			if err == nil {
+				t.Error(c.s, "parsed as", f)
+			}
+			continue
+		}
+		if err != nil || f.String() != c.want {
+			t.Error(c.s, f, err)
+		}
+	}
+}
+
+// fallbackServer 返回认证失败的连接交给 f 处理的服务器，TLS 配置与 main 中启用内置网站时一致
+func fallbackServer(t *testing.T, f fallbackHandler) *myServer {
+	tlsConfig := testTLSConfig(t)
+	if _, ok := f.(*fallbackSite); ok {
+		tlsConfig.NextProtos = fallbackNextProtos
+	}
+	server, _ := newTestServer(t, newSingleUserStore("password"))
+	server.tlsConfig = tlsConfig
+	server.fallback = f
+	return server
+}
+
+func TestFallbackBackend(t *testing.T) {
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	for _, network := range []string{"tcp", "unix"} {
+		t.Run(network, func(t *testing.T) {
+			address := "127.0.0.1:0"
+			if network == "unix" {
+				address = filepath.Join(t.TempDir(), "backend.sock")
+			}
+			l, err := net.Listen(network, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			received := make(chan []byte, 1)
+			go func() {
+				c, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				b := make([]byte, len(request))
+				io.ReadFull(c, b)
+				received <- b
+				c.Write([]byte("HTTP/1.1 204 No Content\r\n\r\n"))
+			}()
+
+			server := fallbackServer(t, &fallbackBackend{network: network, address: l.Addr().String()})
+			conn := dialTestServer(t, server)
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err = conn.Write(request); err != nil {
+				t.Fatal(err)
+			}
+			// 后端收到的是解密后与客户端发送完全一致的字节，响应原样返回
+			if got := <-received; !bytes.Equal(got, request) {
+				t.Fatalf("backend got %q", got)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil || resp.StatusCode != http.StatusNoContent {
+				t.Fatal(resp, err)
+			}
+		})
+	}
+}
+
+func writeSiteFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestStaticSite(t *testing.T) {
+	root := writeSiteFiles(t, map[string]string{
+		"index.html":  "home",
+		"404.html":    "custom not found",
+		"docs/a.txt":  "a",
+		".git/config": "secret",
+	})
+	f, err := newStaticSite(root, "nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		method, path string
+		code         int
+		body         string // 为空时不检查
+	}{
+		{"GET", "/", http.StatusOK, "home"},
+		{"GET", "/index.html", http.StatusOK, "home"},
+		{"GET", "/docs/a.txt", http.StatusOK, "a"},
+		{"GET", "/docs", http.StatusMovedPermanently, ""},
+		{"GET", "/docs/", http.StatusForbidden, "403 Forbidden"},
+		{"GET", "/.git/config", http.StatusNotFound, "custom not found"},
+		{"GET", "/missing", http.StatusNotFound, "custom not found"},
+		{"POST", "/", http.StatusMethodNotAllowed, "405 Method Not Allowed"},
+		{"HEAD", "/missing", http.StatusNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		f.ServeHTTP(w, httptest.NewRequest(c.method, c.path, nil))
+		if w.Code != c.code || !strings.Contains(w.Body.String(), c.body) {
+			t.Error(c.method, c.path, w.Code, w.Body.String())
+		}
+		if w.Header().Get("Server") != "nginx" {
+			t.Error(c.method, c.path, "server", w.Header().Get("Server"))
+		}
+		if c.method == "HEAD" && w.Body.Len() > 0 {
+			t.Error("body in a HEAD response")
+		}
+	}
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "/docs", nil))
+	if w.Header().Get("Location") != "/docs/" {
+		t.Error("redirect to", w.Header().Get("Location"))
+	}
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if w.Header().Get("Allow") != "GET, HEAD" {
+		t.Error("allow", w.Header().Get("Allow"))
+	}
+
+	if _, err = newStaticSite(filepath.Join(root, "index.html"), ""); err == nil {
+		t.Error("a file served as a site")
+	}
+}
+
+// fallbackClient 返回经过服务器 fallback 访问内置网站的 HTTP 客户端，proto 为客户端提供的 ALPN
+func fallbackClient(t *testing.T, server *myServer, proto string) *http.Client {
+	dial := func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go handleTcpConnection(context.Background(), c2, server)
+		conn := tls.Client(c1, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{proto}})
+		if err := conn.HandshakeContext(ctx); err != nil {
+			c1.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	var transport http.RoundTripper
+	if proto == http2.NextProtoTLS {
+		transport = &http2.Transport{DialTLSContext: dial}
+	} else {
+		transport = &http.Transport{DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, network, addr, nil)
+		}}
+	}
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	t.Cleanup(client.CloseIdleConnections)
+	return client
+}
+
+func TestFallbackSiteALPN(t *testing.T) {
+	root := writeSiteFiles(t, map[string]string{"index.html": "home"})
+	f, err := newStaticSite(root, "nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := fallbackServer(t, f)
+	// 按 TLS 握手协商的 ALPN 提供 HTTP/2 或 HTTP/1.1
+	for _, c := range []struct {
+		proto string
+		major int
+	}{
+		{http2.NextProtoTLS, 2},
+		{"http/1.1", 1},
+	} {
+		resp, err := fallbackClient(t, server, c.proto).Get("https://example.com/")
+		if err != nil {
+			t.Fatal(c.proto, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.ProtoMajor != c.major || string(body) != "home" {
+			t.Fatal(c.proto, resp.Proto, string(body))
+		}
+	}
+}
+
+func TestProxySite(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.Header().Set("Server", "upstream/1.0")
+		w.Write([]byte("from upstream"))
+	}))
+	defer upstream.Close()
+	f, err := newProxySite(upstream.URL, "nginx")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "https://example.com/a?b=c", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1") // 客户端伪造的请求头不会被信任
+	w := httptest.NewRecorder()
+	f.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "from upstream" {
+		t.Fatal(w.Code, w.Body.String())
+	}
+	// 上游的 Server 被替换为自己的
+	if w.Header().Get("Server") != "nginx" {
+		t.Error("server", w.Header().Get("Server"))
+	}
+
+	// 与 nginx 的 proxy_pass 一样改写 Host，并附加 X-Forwarded-*
+	got := <-received
+	if got.Host != strings.TrimPrefix(upstream.URL, "http://") || got.URL.RequestURI() != "/a?b=c" {
+		t.Error("upstream request", got.Host, got.URL)
+	}
+	for name, want := range map[string]string{
+		"X-Forwarded-For":   "192.0.2.1",
+		"X-Forwarded-Host":  "example.com",
+		"X-Forwarded-Proto": "https",
+	} {
+		if v := got.Header.Get(name); v != want {
+			t.Error(name, v, "want", want)
+		}
+	}
+
+	// 上游不可用时返回 nginx 样式的 502 页面
+	upstream.Close()
+	w = httptest.NewRecorder()
+	f.ServeHTTP(w, httptest.NewRequest("GET", "https://example.com/", nil))
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Body.String(), "502 Bad Gateway") {
+		t.Error(w.Code, w.Body.String())
+	}
+}
@@ -1,20 +1,22 @@
 package main
 
 import (
-	"anytls/proxy/padding"
 	"anytls/proxy/session"
 	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"net"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	"github.com/sagernet/sing/common/buf"
 	"github.com/sagernet/sing/common/bufio"
 	M "github.com/sagernet/sing/common/metadata"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
 )
 
 func handleTcpConnection(ctx context.Context, c net.Conn, server *myServer) {
@@ -24,40 +26,56 @@ func handleTcpConnection(ctx context.Context, c net.Conn, server *myServer) {
 		}
 	}()
 
-	c = tls.Server(c, server.tlsConfig)
+	tlsConn := tls.Server(c, server.tlsConfig)
+	c = tlsConn
 	defer c.Close()
 
+	// 未完成 TLS 握手或迟迟不发送认证请求的连接不能一直占用 goroutine
+	tlsConn.SetDeadline(time.Now().Add(server.handshakeTimeout))
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		logrus.Debugln("TLS handshake:", c.RemoteAddr(), err)
+		return
+	}
+	if tlsConn.ConnectionState().NegotiatedProtocol == acme.ALPNProto {
+		// TLS-ALPN-01 验证在握手中已经完成
+		return
+	}
+	tlsConn.SetDeadline(time.Now().Add(server.authTimeout))
+
 	b := buf.NewPacket()
 	defer b.Release()
 
-	n, err := b.ReadOnceFrom(c)
-	if err != nil {
-		logrus.Debugln("ReadOnceFrom:", err)
+	r := &authReader{conn: tlsConn, buffer: b}
+	user := server.authenticate(tlsConn, r)
+	if user == nil {
+		// 已读取的字节都还在 b 中，原样交给 fallback
+		tlsConn.SetDeadline(time.Time{})
+		fallback(ctx, bufio.NewCachedConn(c, b), server)
 		return
 	}
-	c = bufio.NewCachedConn(c, b)
+	ctx = contextWithUser(ctx, user.Name)
 
-	by, err := b.ReadBytes(32)
-	if err != nil || !bytes.Equal(by, passwordSha256) {
-		b.Resize(0, n)
-		fallback(ctx, c)
-		return
-	}
-	by, err = b.ReadBytes(2)
+	// 认证已经成功，之后的读取失败不再 fallback
+	by, err := r.next(2)
 	if err != nil {
-		b.Resize(0, n)
-		fallback(ctx, c)
+		logrus.Debugln("read padding0 length:", c.RemoteAddr(), err)
 		return
 	}
 	paddingLen := binary.BigEndian.Uint16(by)
-	if paddingLen > 0 {
-		_, err = b.ReadBytes(int(paddingLen))
-		if err != nil {
-			b.Resize(0, n)
-			fallback(ctx, c)
-			return
-		}
+	if _, err = r.next(int(paddingLen)); err != nil {
+		logrus.Debugln("read padding0:", c.RemoteAddr(), err)
+		return
 	}
+	tlsConn.SetDeadline(time.Time{})
+	// 认证请求之后已经读到的字节属于会话
+	c = &cachedConn{Conn: c, cached: bytes.Clone(b.From(r.offset))}
+
+	serverName := tlsConn.ConnectionState().ServerName
+	scheme := server.padding.selectScheme(user.Name, serverName)
+	scheme.active.Add(1)
+	scheme.total.Add(1)
+	defer scheme.active.Add(-1)
+	logrus.Debugf("[Session] %s user %s sni %q uses padding scheme %s (%s)", c.RemoteAddr(), user.Name, serverName, scheme.name, scheme.factory.Load().Md5)
 
 	session := session.NewServerSession(c, func(stream *session.Stream) {
 		defer func() {
@@ -67,23 +85,77 @@ func handleTcpConnection(ctx context.Context, c net.Conn, server *myServer) {
 		}()
 		defer stream.Close()
 
+		if server.quotaExceeded(user.Name) {
+			// 客户端会收到带有错误信息的 cmdSYNACK
+			stream.HandshakeFailure(errQuotaExceeded)
+			logrus.Debugln("[Session] rejected stream: traffic quota exceeded, user", user.Name)
+			return
+		}
+
 		destination, err := M.SocksaddrSerializer.ReadAddrPort(stream)
 		if err != nil {
-			logrus.Debugln("ReadAddrPort:", err)
+			logrus.Debugln("ReadAddrPort:", err, "user", user.Name)
 			return
 		}
 
-		if strings.Contains(destination.String(), "udp-over-tcp.arpa") {
+		if destination == session.DatagramDestination {
+			proxyOutboundDatagram(ctx, stream, server)
+		} else if strings.Contains(destination.String(), "udp-over-tcp.arpa") {
 			proxyOutboundUoT(ctx, stream, destination, server)
 		} else {
 			proxyOutboundTCP(ctx, stream, destination, server)
 		}
-	}, &padding.DefaultPaddingFactory)
+	}, scheme.factory)
+	session.SetHeartbeat(server.heartbeat)
+	session.SetMaxFrameSize(server.maxFrameSize)
+	session.SetServerPadding(server.serverPadding)
+	session.SetTrafficCounter(server.traffic.counter(user.Name))
+	server.limiters.apply(session, user)
+	server.addSession(session, user.Name)
+	defer server.removeSession(session)
 	session.Run()
 	session.Close()
 }
 
-func fallback(ctx context.Context, c net.Conn) {
-	// 暂未实现
-	logrus.Debugln("fallback:", c.RemoteAddr())
+var errQuotaExceeded = errors.New("traffic quota exceeded")
+
+// cachedConn 先读出缓存的字节再读取连接。与 bufio.CachedConn 不同，Close 不修改缓存，
+// 关闭失效用户的会话时 Close 与会话的读循环并发调用
+type cachedConn struct {
+	net.Conn
+	cached []byte
+}
+
+func (c *cachedConn) Read(p []byte) (int, error) {
+	if len(c.cached) > 0 {
+		n := copy(p, c.cached)
+		c.cached = c.cached[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+var errAuthTooLarge = errors.New("authentication request larger than the buffer")
+
+// authReader 增量读取认证请求：一个认证请求可能被拆分到多个 TLS 记录中，
+// 按需读取直到凑够要解析的字节，已读取的字节始终保留在 buffer 中，以便 fallback 时原样重放
+type authReader struct {
+	conn   net.Conn
+	buffer *buf.Buffer
+	offset int // 已解析的字节数
+}
+
+// next 读取直到有 n 个未解析的字节并返回它们，读取受连接的 deadline 约束
+func (r *authReader) next(n int) ([]byte, error) {
+	for r.buffer.Len() < r.offset+n {
+		if r.buffer.FreeLen() == 0 {
+			return nil, errAuthTooLarge
+		}
+		if _, err := r.buffer.ReadOnceFrom(r.conn); err != nil {
+			return nil, err
+		}
+	}
+	b := r.buffer.Range(r.offset, r.offset+n)
+	r.offset += n
+	return b, nil
 }
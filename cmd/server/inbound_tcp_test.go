@@ -0,0 +1,230 @@
+package main
+
+import (
+	"anytls/proxy/auth"
+	"anytls/proxy/padding"
+	"anytls/proxy/session"
+	"anytls/util"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// testTLSConfig 返回使用自签名证书的服务器 TLS 配置
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	cert, err := util.GenerateKeyPair(time.Now, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{*cert}}
+}
+
+// recordingFallback 记录交给 fallback 的连接上首次读到的字节及其时间
+type recordingFallback struct {
+	got chan []byte
+	at  chan time.Time
+}
+
+func newRecordingFallback() *recordingFallback {
+	return &recordingFallback{got: make(chan []byte, 1), at: make(chan time.Time, 1)}
+}
+
+func (f *recordingFallback) serve(ctx context.Context, c net.Conn) {
+	f.at <- time.Now()
+	b := make([]byte, 1024)
+	n, _ := c.Read(b)
+	f.got <- b[:n]
+}
+
+func (f *recordingFallback) String() string {
+	return "recording"
+}
+
+// dialTestServer 在 net.Pipe 上运行 handleTcpConnection，返回完成握手的客户端连接，nextProtos 为客户端提供的 ALPN
+func dialTestServer(t *testing.T, server *myServer, nextProtos ...string) *tls.Conn {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	go handleTcpConnection(context.Background(), c2, server)
+	conn := tls.Client(c1, &tls.Config{InsecureSkipVerify: true, NextProtos: nextProtos})
+	// 不经过 tls.Conn.Close，close_notify 在没人读取的 net.Pipe 上会阻塞
+	t.Cleanup(func() { c1.Close() })
+	if err := conn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// writeFileLater 写入文件，每次写入都把修改时间往后推，避免文件系统的时间精度不足导致不重新加载
+func writeFileLater(t *testing.T, path string, content []byte) {
+	t.Helper()
+	modTime := time.Now()
+	if info, err := os.Stat(path); err == nil && !info.ModTime().Before(modTime) {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestServer 返回可以运行会话的服务器，认证失败的连接交给 recordingFallback
+func newTestServer(t *testing.T, users *userStore) (*myServer, *recordingFallback) {
+	t.Helper()
+	traffic, err := loadTrafficStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newRecordingFallback()
+	return &myServer{
+		tlsConfig:        testTLSConfig(t),
+		handshakeTimeout: time.Second,
+		authTimeout:      500 * time.Millisecond,
+		authV1:           true,
+		replayCache:      auth.NewReplayCache(),
+		users:            users,
+		traffic:          traffic,
+		limiters:         newRateLimiters(rateLimit{}, rateLimit{}),
+		padding:          newPaddingSelector(),
+		sessions:         make(map[*session.Session]string),
+		fallback:         f,
+	}, f
+}
+
+// loginTestServer 以 v2 认证登录，返回运行在该连接上的客户端会话
+func loginTestServer(t *testing.T, server *myServer, password string) *session.Session {
+	t.Helper()
+	conn := dialTestServer(t, server)
+	exporter, err := auth.Exporter(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte(password))
+	request := append(auth.NewRequestV2(hash[:], exporter, time.Now()), 0, 0) // padding0 长度为 0
+	if _, err = conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	// 会话随 dialTestServer 关闭底层连接而结束
+	cli := session.NewClientSession(conn, &padding.DefaultPaddingFactory)
+	cli.Run()
+	return cli
+}
+
+// waitSessions 等待服务器上活跃会话的数量变为 n
+func waitSessions(t *testing.T, server *myServer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		server.sessionsLock.Lock()
+		got := len(server.sessions)
+		server.sessionsLock.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(got, "sessions, want", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startEchoServer 启动一个原样返回收到数据的 TCP 目标
+func startEchoServer(t *testing.T) M.Socksaddr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return M.SocksaddrFromNet(l.Addr())
+}
+
+// openTestStream 打开一个连接到 destination 的 Stream
+func openTestStream(t *testing.T, cli *session.Session, destination M.Socksaddr) *session.Stream {
+	t.Helper()
+	stream, err := cli.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stream.Close() })
+	if err = M.SocksaddrSerializer.WriteAddrPort(stream, destination); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	return stream
+}
+
+// echo 经过 Stream 发送 n 个字节并读回
+func echo(stream *session.Stream, n int) error {
+	if _, err := stream.Write(make([]byte, n)); err != nil {
+		return err
+	}
+	_, err := io.ReadFull(stream, make([]byte, n))
+	return err
+}
+
+func TestAuthFallback(t *testing.T) {
+	const authTimeout = 500 * time.Millisecond
+	for _, c := range []struct {
+		name    string
+		payload []byte
+		wait    bool // 字节不足以判定认证失败，应等到认证时限
+	}{
+		{"wrong id", bytes.Repeat([]byte{'x'}, auth.IDLen+2), false},
+		{"short http request", []byte("GET / HTTP/1.0\r\n\r\n"), true},
+		{"partial id", auth.ID([]byte("password"))[:auth.IDLen-1], true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			f := newRecordingFallback()
+			server := &myServer{
+				tlsConfig:        testTLSConfig(t),
+				handshakeTimeout: time.Second,
+				authTimeout:      authTimeout,
+				authV1:           true,
+				replayCache:      auth.NewReplayCache(),
+				users:            newSingleUserStore("password"),
+				fallback:         f,
+			}
+			conn := dialTestServer(t, server)
+			sent := time.Now()
+			if _, err := conn.Write(c.payload); err != nil {
+				t.Fatal(err)
+			}
+			var at time.Time
+			select {
+			case at = <-f.at:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no fallback")
+			}
+			if waited := at.Sub(sent); c.wait != (waited >= authTimeout) {
+				t.Fatal("fell back after", waited)
+			}
+			// fallback 收到的字节与客户端发送的完全一致
+			if got := <-f.got; !bytes.Equal(got, c.payload) {
+				t.Fatalf("fallback got %q", got)
+			}
+		})
+	}
+}
@@ -1,23 +1,68 @@
 package main
 
 import (
+	"anytls/proxy/auth"
+	"anytls/proxy/padding"
+	"anytls/proxy/session"
 	"anytls/proxy/simpledialer"
 	"crypto/tls"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultAuthTimeout      = 10 * time.Second
+)
+
 type myServer struct {
-	tlsConfig   *tls.Config
-	proxyDialer *simpledialer.SimpleDialer
+	tlsConfig *tls.Config
+	// TLS 握手与读取认证请求各自的时限
+	handshakeTimeout time.Duration
+	authTimeout      time.Duration
+	proxyDialer      *simpledialer.SimpleDialer
+	heartbeat        session.HeartbeatConfig
+	maxFrameSize     int
+
+	// 服务器到客户端方向的填充方案，nil 为不填充
+	serverPadding *padding.PaddingFactory
+	// 按用户与 SNI 选择客户端方向的填充方案
+	padding *paddingSelector
+
+	// 是否接受 v1 认证（静态 sha256(password)），迁移完成后应关闭
+	authV1      bool
+	replayCache *auth.ReplayCache
+
+	// 用户库，单密码模式下只有一个 default 用户
+	users *userStore
+
+	// 按用户统计的当月流量，quotaCloseSessions 为真时流量用完立即关闭已有会话
+	traffic            *trafficStore
+	quotaCloseSessions bool
+
+	// 全局、每个会话与每个用户的限速
+	limiters *rateLimiters
+
+	// 认证失败的连接的处理方式，nil 为直接关闭
+	fallback fallbackHandler
+
+	sessions     map[*session.Session]string // 会话所属的用户名
+	sessionsLock sync.Mutex
 }
 
 func NewMyServer(tlsConfig *tls.Config, dialURL string, dialFallback bool, healthCheckURLs string, healthCheckInterval time.Duration, healthCheckTimeout time.Duration, healthCheckThreshold int, dataTransferIdle time.Duration, connectTimeout time.Duration, readTimeout time.Duration, writeTimeout time.Duration) *myServer {
 	s := &myServer{
-		tlsConfig: tlsConfig,
+		tlsConfig:        tlsConfig,
+		handshakeTimeout: defaultHandshakeTimeout,
+		authTimeout:      defaultAuthTimeout,
+		sessions:         make(map[*session.Session]string),
+		padding:          newPaddingSelector(),
+		authV1:           true,
+		replayCache:      auth.NewReplayCache(),
 	}
 
 	// 如果配置了出站代理，初始化代理拨号器
@@ -95,3 +140,149 @@ func (s *myServer) GetDialer() interface{} {
 		Timeout: time.Second * 30,
 	}
 }
+
+// addSession 记录活跃会话及其用户，用于优雅关闭和关闭失效用户的会话
+func (s *myServer) addSession(sess *session.Session, userName string) {
+	s.sessionsLock.Lock()
+	s.sessions[sess] = userName
+	s.sessionsLock.Unlock()
+}
+
+// removeSession 移除已结束的会话
+func (s *myServer) removeSession(sess *session.Session) {
+	s.sessionsLock.Lock()
+	delete(s.sessions, sess)
+	s.sessionsLock.Unlock()
+}
+
+// GoAway 通知所有会话不再接受新的 Stream，已有 Stream 结束后会话关闭
+func (s *myServer) GoAway(reason string) {
+	s.sessionsLock.Lock()
+	sessions := make([]*session.Session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	s.sessionsLock.Unlock()
+
+	for _, sess := range sessions {
+		sess.GoAway(reason)
+	}
+	logrus.Infof("[Server] Sent GOAWAY to %d sessions", len(sessions))
+}
+
+// authenticate 读取并校验认证请求，返回对应的用户，失败时返回 nil。
+// 只有读满 32 字节的 ID（v2 还有其余 56 字节）后才能判定认证失败：字节不足时继续等待直到 auth deadline，
+// 不会根据部分 ID 提前判定，否则可以通过响应时间逐字节探测出 ID。
+func (s *myServer) authenticate(tlsConn *tls.Conn, r *authReader) *user {
+	id, err := r.next(auth.IDLen)
+	if err != nil {
+		logrus.Debugln("auth:", tlsConn.RemoteAddr(), err)
+		return nil
+	}
+	now := time.Now()
+	if s.authV1 {
+		if u := s.users.lookupV1(id); u != nil {
+			return s.checkUser(tlsConn, u, now)
+		}
+	}
+	u := s.users.lookupV2(id)
+	if u == nil {
+		return nil
+	}
+	body, err := r.next(auth.RequestV2Len - auth.IDLen)
+	if err != nil {
+		logrus.Debugln("auth v2:", tlsConn.RemoteAddr(), err)
+		return nil
+	}
+	exporter, err := auth.Exporter(tlsConn)
+	if err != nil {
+		logrus.Debugln("auth v2:", err)
+		return nil
+	}
+	now = time.Now()
+	nonce, err := auth.VerifyV2(u.passwordSha256, exporter, body, now)
+	if err == nil {
+		err = s.replayCache.Check(nonce, now)
+	}
+	if err != nil {
+		logrus.Debugln("auth v2:", tlsConn.RemoteAddr(), err)
+		return nil
+	}
+	return s.checkUser(tlsConn, u, now)
+}
+
+// checkUser 拒绝已禁用或已过期的用户
+func (s *myServer) checkUser(tlsConn *tls.Conn, u *user, now time.Time) *user {
+	if !u.valid(now) {
+		logrus.Infof("[Server] %s rejected: user %s is disabled or expired", tlsConn.RemoteAddr(), u.Name)
+		return nil
+	}
+	return u
+}
+
+// reloadUsers 在用户文件修改后重新加载，并关闭已失效用户的会话
+func (s *myServer) reloadUsers() {
+	if s.users.path != "" {
+		changed, err := s.users.reload()
+		if err != nil {
+			logrus.Errorln("[Server] Failed to reload users:", err)
+			return
+		}
+		if changed {
+			s.limiters.update(s.users)
+			logrus.Infoln("[Server] Reloaded users:", s.users.path)
+		}
+	}
+
+	now := time.Now()
+	closed := s.closeSessions(func(name string) bool {
+		u := s.users.lookup(name)
+		return u == nil || !u.valid(now)
+	})
+	if closed > 0 {
+		logrus.Infof("[Server] Closed %d sessions of disabled or expired users", closed)
+	}
+}
+
+// quotaExceeded 判断用户当月的流量是否已用完
+func (s *myServer) quotaExceeded(name string) bool {
+	u := s.users.lookup(name)
+	if u == nil || u.Quota == 0 {
+		return false
+	}
+	usage := s.traffic.usage(name)
+	return usage.Upload+usage.Download >= uint64(u.Quota)
+}
+
+// accountTraffic 在月初清零流量，按配置关闭流量已用完用户的会话，并保存流量文件
+func (s *myServer) accountTraffic() {
+	if s.traffic.rollover(time.Now()) {
+		logrus.Infoln("[Server] New month, traffic counters reset")
+	}
+	if s.quotaCloseSessions {
+		closed := s.closeSessions(s.quotaExceeded)
+		if closed > 0 {
+			logrus.Infof("[Server] Closed %d sessions of users over quota", closed)
+		}
+	}
+	if err := s.traffic.save(); err != nil {
+		logrus.Errorln("[Server] Failed to save traffic:", err)
+	}
+}
+
+// closeSessions 关闭所属用户满足条件的会话，返回关闭的数量
+func (s *myServer) closeSessions(match func(userName string) bool) int {
+	var matched []*session.Session
+	s.sessionsLock.Lock()
+	for sess, name := range s.sessions {
+		if match(name) {
+			matched = append(matched, sess)
+		}
+	}
+	s.sessionsLock.Unlock()
+
+	for _, sess := range matched {
+		sess.Close()
+	}
+	return len(matched)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"anytls/proxy/session"
 	"anytls/proxy/simpledialer"
 	"context"
 	"net"
@@ -14,7 +15,8 @@ import (
 )
 
 func proxyOutboundTCP(ctx context.Context, conn net.Conn, destination M.Socksaddr, server *myServer) error {
-	logrus.Debugf("ProxyOutboundTCP: New connection from %s to %s", conn.RemoteAddr(), destination)
+	user := userFromContext(ctx)
+	logrus.Debugf("ProxyOutboundTCP: New connection from %s (user %s) to %s", conn.RemoteAddr(), user, destination)
 
 	// 获取拨号器
 	dialerInterface := server.GetDialer()
@@ -26,18 +28,18 @@ func proxyOutboundTCP(ctx context.Context, conn net.Conn, destination M.Socksadd
 		// 使用简化代理拨号器
 		outboundConn, err = proxyDialer.DialContext(ctx, "tcp", destination.String())
 		if err != nil {
-			logrus.Debugln("TCP proxy failed:", err)
+			logrus.Debugln("TCP proxy failed:", err, "user", user)
 			return E.Errors(err, N.ReportHandshakeFailure(conn, err))
 		}
-		logrus.Debugln("Using TCP proxy for:", destination.String(), "via", proxyDialer.GetCurrentProxy())
+		logrus.Debugln("Using TCP proxy for:", destination.String(), "via", proxyDialer.GetCurrentProxy(), "user", user)
 	} else if dialer, ok := dialerInterface.(*net.Dialer); ok {
 		// 使用系统拨号器
 		outboundConn, err = dialer.DialContext(ctx, "tcp", destination.String())
 		if err != nil {
-			logrus.Debugln("Direct dial failed:", err)
+			logrus.Debugln("Direct dial failed:", err, "user", user)
 			return E.Errors(err, N.ReportHandshakeFailure(conn, err))
 		}
-		logrus.Debugln("Using direct TCP for:", destination.String())
+		logrus.Debugln("Using direct TCP for:", destination.String(), "user", user)
 	} else {
 		// 回退到默认拨号
 		outboundConn, err = net.DialTCP("tcp", nil, &net.TCPAddr{
@@ -45,10 +47,10 @@ func proxyOutboundTCP(ctx context.Context, conn net.Conn, destination M.Socksadd
 			Port: int(destination.Port),
 		})
 		if err != nil {
-			logrus.Debugln("Default dial failed:", err)
+			logrus.Debugln("Default dial failed:", err, "user", user)
 			return E.Errors(err, N.ReportHandshakeFailure(conn, err))
 		}
-		logrus.Debugln("Using default TCP for:", destination.String())
+		logrus.Debugln("Using default TCP for:", destination.String(), "user", user)
 	}
 
 	// 报告握手成功
@@ -58,7 +60,14 @@ func proxyOutboundTCP(ctx context.Context, conn net.Conn, destination M.Socksadd
 		return err
 	}
 
+	// 出站连接被 RST 时向客户端发送 cmdRST，客户端 RST Stream 时出站连接也以 RST 关闭
+	if stream, ok := conn.(*session.Stream); ok {
+		outboundConn = session.NewResetConn(outboundConn, stream)
+	}
+
 	// 开始数据转发
+	// Stream 与 TCPConn 都实现了 CloseWrite，CopyConn 在一个方向读到 EOF 时只关闭对端的写方向，
+	// 从而把 TCP 半关闭（half-close）端到端地传递给客户端
 	defer outboundConn.Close()
 	return bufio.CopyConn(ctx, conn, outboundConn)
 }
@@ -69,6 +78,8 @@ func proxyOutboundUoT(ctx context.Context, conn net.Conn, destination M.Socksadd
 		logrus.Debugln("proxyOutboundUoT ReadRequest:", err)
 		return err
 	}
+	user := userFromContext(ctx)
+	logrus.Debugf("proxyOutboundUoT: New flow from %s (user %s) to %s", conn.RemoteAddr(), user, request.Destination)
 
 	// 尝试使用代理拨号器
 	dialerInterface := server.GetDialer()
@@ -80,9 +91,9 @@ func proxyOutboundUoT(ctx context.Context, conn net.Conn, destination M.Socksadd
 		if err == nil {
 			// 对于 UDP over TCP，我们使用 TCP 连接
 			c = &ConnToPacketConnAdapter{Conn: udpConn}
-			logrus.Debugln("Using TCP proxy for UoT:", destination.String(), "via", proxyDialer.GetCurrentProxy())
+			logrus.Debugln("Using TCP proxy for UoT:", destination.String(), "via", proxyDialer.GetCurrentProxy(), "user", user)
 		} else {
-			logrus.Debugln("TCP proxy failed for UoT, using local UDP:", err)
+			logrus.Debugln("TCP proxy failed for UoT, using local UDP:", err, "user", user)
 			// 代理失败，回退到本地 UDP
 			c, err = net.ListenPacket("udp", "")
 			if err != nil {
@@ -110,6 +121,31 @@ func proxyOutboundUoT(ctx context.Context, conn net.Conn, destination M.Socksadd
 	return bufio.CopyPacketConn(ctx, uot.NewConn(conn, *request), bufio.NewPacketConn(c))
 }
 
+// proxyOutboundDatagram 处理原生 UDP 数据报流：每个数据报携带目标地址，使用一个本地 UDP socket 收发
+func proxyOutboundDatagram(ctx context.Context, stream *session.Stream, server *myServer) error {
+	packetConn, err := session.AcceptPacketConn(stream)
+	if err != nil {
+		logrus.Debugln("proxyOutboundDatagram AcceptPacketConn:", err)
+		return E.Errors(err, N.ReportHandshakeFailure(stream, err))
+	}
+	logrus.Debugf("proxyOutboundDatagram: New flow from %s (user %s)", stream.RemoteAddr(), userFromContext(ctx))
+
+	// 简化代理拨号器只支持 TCP，数据报流总是使用本地 UDP
+	c, err := net.ListenPacket("udp", "")
+	if err != nil {
+		logrus.Debugln("proxyOutboundDatagram ListenPacket:", err)
+		return E.Errors(err, N.ReportHandshakeFailure(stream, err))
+	}
+	defer c.Close()
+
+	err = N.ReportHandshakeSuccess(stream)
+	if err != nil {
+		return err
+	}
+
+	return bufio.CopyPacketConn(ctx, packetConn, bufio.NewPacketConn(c))
+}
+
 // ConnToPacketConnAdapter 将 net.Conn 适配为 net.PacketConn
 type ConnToPacketConnAdapter struct {
 	net.Conn
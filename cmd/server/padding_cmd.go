@@ -0,0 +1,190 @@
+package main
+
+import (
+	"anytls/proxy/auth"
+	"anytls/proxy/padding"
+	"bufio"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// frameHeaderSize 是 cmdWaste 帧头的长度，见 proxy/session/frame.go
+const frameHeaderSize = 7
+
+// tlsMaxPlaintext 是单个 TLS 记录的最大明文长度，更大的 Write 会被拆分
+const tlsMaxPlaintext = 16384
+
+// defaultTrace 是没有指定流量样本时使用的典型 HTTPS 代理请求，每项为会话的一次写入
+var defaultTrace = []int{
+	90,   // cmdSettings + cmdSYN + cmdPSH(目标地址)
+	517,  // TLS ClientHello
+	80,   // ChangeCipherSpec + Finished
+	600,  // HTTP 请求
+	40,   // 确认
+	1400, // 上传
+	1400,
+	1400,
+	1400,
+	200,
+}
+
+// paddingCommand 实现 `padding` 子命令：检查填充方案并模拟其产生的 TLS 记录
+func paddingCommand(args []string) int {
+	fs := flag.NewFlagSet("padding", flag.ExitOnError)
+	tracePath := fs.String("trace", "", "traffic trace file, one session write size in bytes per line starting at packet 1 (default: a typical HTTPS request)")
+	runs := fs.Int("runs", 1000, "number of simulated connections")
+	bucket := fs.Int("bucket", 200, "histogram bucket width in bytes")
+	compatible := fs.Bool("compatible", false, "simulate the version 1 scheme sent to clients without padding-v2")
+	authVersion := fs.Int("auth-version", 1, "authentication version of the simulated client, the v2 request is larger")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: anytls-server padding [flags] scheme-file")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || *runs < 1 || *bucket < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	rawScheme, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	trace := defaultTrace
+	if *tracePath != "" {
+		if trace, err = readTrace(*tracePath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	exitCode := 0
+	for _, problem := range padding.CheckPaddingScheme(rawScheme) {
+		fmt.Printf("%s: %s\n", fs.Arg(0), problem)
+		if !problem.Warning {
+			exitCode = 1
+		}
+	}
+	p := padding.NewPaddingFactory(rawScheme)
+	if p == nil {
+		fmt.Println("scheme is rejected")
+		return 1
+	}
+	if *compatible {
+		p = p.Compatible()
+		fmt.Printf("version 1 scheme:\n%s\n\n", p.RawScheme)
+	}
+	fmt.Printf("version %d, stop %d, md5 %s\n\n", p.Version, p.Stop, p.Md5)
+
+	fmt.Println("sample connection:")
+	for pkt, payload := range append([]int{authPayload(p, *authVersion)}, trace...) {
+		records, delay := simulatePacket(p, uint32(pkt), payload)
+		fmt.Printf("  pkt %-3d payload %-6d records %v", pkt, payload, records)
+		if delay > 0 {
+			fmt.Printf(" after %s", delay)
+		}
+		fmt.Println()
+	}
+
+	var payloadTotal, wireTotal, recordCount int
+	var delayTotal time.Duration
+	histogram := make(map[int]int)
+	for range *runs {
+		for pkt, payload := range append([]int{authPayload(p, *authVersion)}, trace...) {
+			records, delay := simulatePacket(p, uint32(pkt), payload)
+			payloadTotal += payload
+			delayTotal += delay
+			for _, size := range records {
+				wireTotal += size
+				recordCount++
+				histogram[size / *bucket]++
+			}
+		}
+	}
+
+	fmt.Printf("\n%d connections: payload %d bytes, records %d bytes, overhead %.1f%%, %.1f records and %s delay per connection\n",
+		*runs, payloadTotal, wireTotal, float64(wireTotal-payloadTotal)*100/float64(payloadTotal),
+		float64(recordCount)/float64(*runs), delayTotal/time.Duration(*runs))
+	fmt.Println("\nrecord sizes:")
+	maxBucket, maxCount := 0, 0
+	for b, count := range histogram {
+		maxBucket, maxCount = max(maxBucket, b), max(maxCount, count)
+	}
+	for b := 0; b <= maxBucket; b++ {
+		count := histogram[b]
+		fmt.Printf("  %5d-%-5d %6.2f%% %s\n", b**bucket, (b+1)**bucket-1,
+			float64(count)*100/float64(recordCount), strings.Repeat("#", count*50/maxCount))
+	}
+	return exitCode
+}
+
+// authPayload 对应客户端认证包：认证请求 + uint16 填充长度 + 填充。
+// v1 的认证请求为 sha256(password)，v2 见 proxy/auth
+func authPayload(p *padding.PaddingFactory, authVersion int) int {
+	size := sha256.Size + 2
+	if authVersion >= 2 {
+		size = auth.RequestV2Len + 2
+	}
+	if pad := p.GenerateRecordPayloadSizes(0); len(pad) > 0 && pad[0] > 0 {
+		size += pad[0]
+	}
+	return size
+}
+
+// simulatePacket 按 Session.writeConn 使用的 SplitPacket 分包，返回 TLS 记录的明文长度与等待时间
+func simulatePacket(p *padding.PaddingFactory, pkt uint32, payload int) (records []int, delay time.Duration) {
+	var writes []int
+	if pkt == 0 {
+		// 认证包不分包
+		writes = append(writes, payload)
+	} else {
+		for _, w := range p.SplitPacket(pkt, payload, frameHeaderSize) {
+			delay += w.Delay
+			writes = append(writes, w.Payload+w.Padding)
+		}
+	}
+	for _, size := range writes {
+		for size > tlsMaxPlaintext {
+			records = append(records, tlsMaxPlaintext)
+			size -= tlsMaxPlaintext
+		}
+		records = append(records, size)
+	}
+	return
+}
+
+// readTrace 读取流量样本，忽略空行与 # 开头的注释
+func readTrace(path string) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var trace []int
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		size, err := strconv.Atoi(text)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("%s: line %d: bad size %q", path, line, text)
+		}
+		trace = append(trace, size)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(trace) == 0 {
+		return nil, fmt.Errorf("%s: empty trace", path)
+	}
+	return trace, nil
+}
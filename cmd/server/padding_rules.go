@@ -0,0 +1,148 @@
+package main
+
+import (
+	"anytls/proxy/padding"
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	atomic2 "github.com/sagernet/sing/common/atomic"
+)
+
+// paddingScheme 是一个可被会话选用的填充方案及其统计
+type paddingScheme struct {
+	name    string
+	factory *atomic2.TypedValue[*padding.PaddingFactory]
+
+	active atomic.Int64 // 正在使用的会话数
+	total  atomic.Int64 // 累计使用的会话数
+}
+
+// paddingRule 按用户名或 TLS ServerName 匹配填充方案
+type paddingRule struct {
+	kind    string // "user" 或 "sni"
+	pattern string
+	scheme  *paddingScheme
+}
+
+// paddingSelector 为每个会话选择填充方案，规则按顺序匹配，都不匹配时使用默认方案
+type paddingSelector struct {
+	rules         []paddingRule
+	defaultScheme *paddingScheme
+}
+
+func newPaddingSelector() *paddingSelector {
+	return &paddingSelector{
+		defaultScheme: &paddingScheme{name: "default", factory: &padding.DefaultPaddingFactory},
+	}
+}
+
+// loadPaddingRules 读取规则文件，每行为 `user:名称 方案文件` 或 `sni:域名 方案文件`，
+// 域名可以是 `*.example.com` 形式，方案文件的相对路径相对于规则文件所在目录。
+func loadPaddingRules(path string) (*paddingSelector, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := newPaddingSelector()
+	schemes := make(map[string]*paddingScheme)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: line %d: want `user:name scheme-file` or `sni:host scheme-file`", path, line)
+		}
+		kind, pattern, _ := strings.Cut(fields[0], ":")
+		if (kind != "user" && kind != "sni") || pattern == "" {
+			return nil, fmt.Errorf("%s: line %d: unknown match %q", path, line, fields[0])
+		}
+		if kind == "sni" {
+			pattern = strings.ToLower(pattern)
+			// 通配符只能作为第一个标签，`*foo.com` 之类的写法没有明确含义
+			if strings.Contains(pattern, "*") {
+				suffix, ok := strings.CutPrefix(pattern, "*.")
+				if !ok || suffix == "" || strings.Contains(suffix, "*") {
+					return nil, fmt.Errorf("%s: line %d: wildcard must be the first label, like *.example.com: %q", path, line, fields[0])
+				}
+			}
+		}
+
+		schemePath := fields[1]
+		if !filepath.IsAbs(schemePath) {
+			schemePath = filepath.Join(filepath.Dir(path), schemePath)
+		}
+		scheme, ok := schemes[schemePath]
+		if !ok {
+			b, err := os.ReadFile(schemePath)
+			if err != nil {
+				return nil, fmt.Errorf("%s: line %d: %w", path, line, err)
+			}
+			p := padding.NewPaddingFactory(b)
+			if p == nil {
+				return nil, fmt.Errorf("%s: line %d: wrong format padding scheme file %s: %v", path, line, schemePath, padding.CheckPaddingScheme(b))
+			}
+			scheme = &paddingScheme{name: fields[1], factory: &atomic2.TypedValue[*padding.PaddingFactory]{}}
+			scheme.factory.Store(p)
+			schemes[schemePath] = scheme
+		}
+		s.rules = append(s.rules, paddingRule{kind: kind, pattern: pattern, scheme: scheme})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// selectScheme 返回第一个匹配用户名或 ServerName 的方案
+func (s *paddingSelector) selectScheme(user, serverName string) *paddingScheme {
+	serverName = strings.ToLower(serverName)
+	for _, rule := range s.rules {
+		switch rule.kind {
+		case "user":
+			if user != "" && rule.pattern == user {
+				return rule.scheme
+			}
+		case "sni":
+			if serverName != "" && matchServerName(rule.pattern, serverName) {
+				return rule.scheme
+			}
+		}
+	}
+	return s.defaultScheme
+}
+
+// matchServerName 支持精确匹配与 `*.example.com` 匹配任意子域名，
+// 后缀带着点匹配，`badexample.com` 与 `example.com` 本身都不匹配
+func matchServerName(pattern, serverName string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(serverName, "."+suffix)
+	}
+	return pattern == serverName
+}
+
+// stats 返回各方案的会话统计，按规则中首次出现的顺序，用于定期输出
+func (s *paddingSelector) stats() []string {
+	seen := map[*paddingScheme]bool{s.defaultScheme: true}
+	schemes := []*paddingScheme{s.defaultScheme}
+	for _, rule := range s.rules {
+		if !seen[rule.scheme] {
+			seen[rule.scheme] = true
+			schemes = append(schemes, rule.scheme)
+		}
+	}
+	var stats []string
+	for _, scheme := range schemes {
+		stats = append(stats, fmt.Sprintf("%s(%s): %d active, %d total",
+			scheme.name, scheme.factory.Load().Md5, scheme.active.Load(), scheme.total.Load()))
+	}
+	return stats
+}
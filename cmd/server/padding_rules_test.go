@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writePaddingRules 在临时目录中写入规则文件与其中引用的方案文件，返回规则文件路径
+func writePaddingRules(t *testing.T, rules string, schemes map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, scheme := range schemes {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(scheme), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, "rules.txt")
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMatchServerName(t *testing.T) {
+	for _, c := range []struct {
+		pattern, serverName string
+		match               bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "www.example.com", false},
+		{"*.example.com", "www.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "badexample.com", false},
+		{"*.example.com", "www.example.com.evil", false},
+	} {
+		if matchServerName(c.pattern, c.serverName) != c.match {
+			t.Error(c.pattern, c.serverName, "match", !c.match)
+		}
+	}
+}
+
+func TestLoadPaddingRules(t *testing.T) {
+	path := writePaddingRules(t, `
+# 注释与空行被忽略
+user:alice   a.txt
+sni:*.Example.com b.txt
+sni:www.example.com a.txt
+user:bob     b.txt
+`, map[string]string{
+		"a.txt": "stop=2\n0=30-30\n1=100-200",
+		"b.txt": "stop=1\n0=50-50",
+	})
+	s, err := loadPaddingRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.rules) != 4 {
+		t.Fatal(len(s.rules), "rules")
+	}
+	// 同一个方案文件只加载一次，统计共用
+	a, b := s.rules[0].scheme, s.rules[1].scheme
+	if s.rules[2].scheme != a || s.rules[3].scheme != b || a == b {
+		t.Fatal("scheme files not shared")
+	}
+	if a.name != "a.txt" || a.factory.Load().Stop != 2 || b.factory.Load().Stop != 1 {
+		t.Fatal("schemes", a.name, a.factory.Load().Stop, b.factory.Load().Stop)
+	}
+
+	for _, c := range []struct {
+		user, serverName string
+		want             *paddingScheme
+	}{
+		{"alice", "www.example.com", a}, // 规则按顺序匹配，用户规则在前
+		{"bob", "www.example.com", b},   // *.example.com 在 www.example.com 之前
+		{"bob", "", b},
+		{"carol", "WWW.EXAMPLE.COM", b}, // 域名不区分大小写
+		{"carol", "example.com", s.defaultScheme},
+		{"", "", s.defaultScheme},
+	} {
+		if got := s.selectScheme(c.user, c.serverName); got != c.want {
+			t.Errorf("user %q sni %q got %s", c.user, c.serverName, got.name)
+		}
+	}
+	if stats := s.stats(); len(stats) != 3 || !strings.HasPrefix(stats[0], "default(") || !strings.HasPrefix(stats[1], "a.txt(") {
+		t.Fatal("stats", stats)
+	}
+}
+
+func TestLoadPaddingRulesInvalid(t *testing.T) {
+	schemes := map[string]string{"a.txt": "stop=1\n0=30-30", "bad.txt": "stop=x"}
+	for _, c := range []struct {
+		name, rules string
+	}{
+		{"one field", "user:alice"},
+		{"three fields", "user:alice a.txt a.txt"},
+		{"unknown kind", "ip:127.0.0.1 a.txt"},
+		{"empty pattern", "user: a.txt"},
+		{"missing scheme", "user:alice missing.txt"},
+		{"bad scheme", "user:alice bad.txt"},
+		{"wildcard suffix", "sni:*example.com a.txt"},
+		{"wildcard inside", "sni:www.*.example.com a.txt"},
+		{"two wildcards", "sni:*.*.example.com a.txt"},
+		{"bare wildcard", "sni:*. a.txt"},
+		{"only wildcard", "sni:* a.txt"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := loadPaddingRules(writePaddingRules(t, c.rules, schemes)); err == nil {
+				t.Fatal("loaded")
+			}
+		})
+	}
+}
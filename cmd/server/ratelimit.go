@@ -0,0 +1,80 @@
+package main
+
+import (
+	"anytls/proxy/session"
+	"sync"
+)
+
+// rateLimit 是每秒的字节数，上行为客户端发往服务器的方向，0 为不限
+type rateLimit struct {
+	Upload   byteSize `json:"upload,omitempty"`
+	Download byteSize `json:"download,omitempty"`
+}
+
+// limiterPair 是一组上行与下行的令牌桶，nil 为不限
+type limiterPair struct {
+	upload   *session.RateLimiter
+	download *session.RateLimiter
+}
+
+func newLimiterPair(limit rateLimit) limiterPair {
+	var p limiterPair
+	if limit.Upload > 0 {
+		p.upload = session.NewRateLimiter(int64(limit.Upload), 0)
+	}
+	if limit.Download > 0 {
+		p.download = session.NewRateLimiter(int64(limit.Download), 0)
+	}
+	return p
+}
+
+// rateLimiters 按全局、会话与用户三级限速，会话同时受三者约束
+type rateLimiters struct {
+	global  limiterPair // 所有会话共用
+	session rateLimit   // 每个会话各自的限速
+
+	lock  sync.Mutex
+	users map[string]limiterPair // 同一用户的所有会话共用
+}
+
+func newRateLimiters(global, perSession rateLimit) *rateLimiters {
+	return &rateLimiters{
+		global:  newLimiterPair(global),
+		session: perSession,
+		users:   make(map[string]limiterPair),
+	}
+}
+
+// apply 为新的会话加上限速，服务器发送的是下行，接收的是上行
+func (r *rateLimiters) apply(sess *session.Session, u *user) {
+	sess.AddRateLimiter(r.global.download, r.global.upload)
+	perSession := newLimiterPair(r.session)
+	sess.AddRateLimiter(perSession.download, perSession.upload)
+
+	// 用户的令牌桶总是创建，重新加载用户文件后可以对已有会话生效
+	r.lock.Lock()
+	p, ok := r.users[u.Name]
+	if !ok {
+		p = limiterPair{
+			upload:   session.NewRateLimiter(int64(u.Limit.Upload), 0),
+			download: session.NewRateLimiter(int64(u.Limit.Download), 0),
+		}
+		r.users[u.Name] = p
+	}
+	r.lock.Unlock()
+	sess.AddRateLimiter(p.download, p.upload)
+}
+
+// update 在用户文件重新加载后更新各用户的限速，已删除的用户不再限速
+func (r *rateLimiters) update(users *userStore) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for name, p := range r.users {
+		var limit rateLimit
+		if u := users.lookup(name); u != nil {
+			limit = u.Limit
+		}
+		p.upload.SetLimit(int64(limit.Upload), 0)
+		p.download.SetLimit(int64(limit.Download), 0)
+	}
+}
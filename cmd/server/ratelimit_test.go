@@ -0,0 +1,77 @@
+package main
+
+import (
+	"anytls/proxy/padding"
+	"anytls/proxy/session"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimitersUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUsers(t, path, `[
+		{"name": "alice", "password": "a", "limit": {"upload": "1MiB", "download": "2MiB"}},
+		{"name": "bob", "password": "b"}
+	]`)
+	users, err := loadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiters := newRateLimiters(rateLimit{Download: 10 << 20}, rateLimit{})
+	if limiters.global.upload != nil || limiters.global.download.Limit() != 10<<20 {
+		t.Fatal("global limiters", limiters.global)
+	}
+	for _, name := range []string{"alice", "alice", "bob"} {
+		c, _ := net.Pipe()
+		defer c.Close()
+		limiters.apply(session.NewServerSession(c, nil, &padding.DefaultPaddingFactory), users.lookup(name))
+	}
+	// 同一用户的会话共用令牌桶，没有限速的用户也有一个，重新加载后可以加上限速
+	if len(limiters.users) != 2 {
+		t.Fatal(len(limiters.users), "user limiters")
+	}
+	alice, bob := limiters.users["alice"], limiters.users["bob"]
+	if alice.upload.Limit() != 1<<20 || alice.download.Limit() != 2<<20 || bob.upload.Limit() != 0 {
+		t.Fatal("user limits")
+	}
+
+	writeUsers(t, path, `[{"name": "bob", "password": "b", "limit": {"download": "512KiB"}}]`)
+	if _, err = users.reload(); err != nil {
+		t.Fatal(err)
+	}
+	limiters.update(users)
+	if bob.download.Limit() != 512<<10 || bob.upload.Limit() != 0 {
+		t.Fatal("bob after reload", bob.upload.Limit(), bob.download.Limit())
+	}
+	// 已删除的用户不再限速
+	if alice.upload.Limit() != 0 || alice.download.Limit() != 0 {
+		t.Fatal("alice after removal", alice.upload.Limit(), alice.download.Limit())
+	}
+}
+
+func TestUserRateLimit(t *testing.T) {
+	const rate = 256 << 10
+	const size = rate * 3 / 2
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUsers(t, path, `[{"name": "alice", "password": "a", "limit": {"download": "256KiB"}}]`)
+	users, err := loadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := newTestServer(t, users)
+	target := startEchoServer(t)
+	cli := loginTestServer(t, server, "a")
+
+	// 令牌桶起初有一秒的突发，之后按限速下行
+	stream := openTestStream(t, cli, target)
+	start := time.Now()
+	if err = echo(stream, size); err != nil {
+		t.Fatal(err)
+	}
+	want := time.Duration(float64(size-rate) / rate * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < want*8/10 || elapsed > want*2+time.Second {
+		t.Fatal("took", elapsed, "want about", want)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"anytls/proxy/session"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// byteSize 是字节数，JSON 中可以写数字或 "100GiB"、"500M" 这样带单位的字符串（按 1024 进制）
+type byteSize uint64
+
+func (b *byteSize) UnmarshalJSON(data []byte) error {
+	var n uint64
+	if err := json.Unmarshal(data, &n); err == nil {
+		*b = byteSize(n)
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid size %s", data)
+	}
+	size, err := parseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+func parseByteSize(s string) (byteSize, error) {
+	number, unit := strings.TrimSpace(s), ""
+	if i := strings.IndexFunc(number, func(r rune) bool { return (r < '0' || r > '9') && r != '.' }); i >= 0 {
+		number, unit = number[:i], strings.ToUpper(strings.TrimSpace(number[i:]))
+	}
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	shift, ok := map[string]uint{"": 0, "K": 10, "M": 20, "G": 30, "T": 40}[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return byteSize(n * float64(uint64(1)<<shift)), nil
+}
+
+func (b byteSize) String() string {
+	const units = "KMGT"
+	if b < 1024 {
+		return strconv.FormatUint(uint64(b), 10) + "B"
+	}
+	v := float64(b)
+	i := -1
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return strconv.FormatFloat(v, 'f', 2, 64) + string(units[i]) + "iB"
+}
+
+// trafficUsage 是流量文件中一个用户的记录，上行为客户端发往服务器的方向
+type trafficUsage struct {
+	Upload   uint64 `json:"upload"`
+	Download uint64 `json:"download"`
+}
+
+// trafficFile 是流量文件的格式，每月一日清零
+type trafficFile struct {
+	Month string                   `json:"month"`
+	Users map[string]*trafficUsage `json:"users"`
+}
+
+// trafficStore 按用户统计当月流量，会话通过 session.TrafficCounter 在 Stream 层计数
+type trafficStore struct {
+	path string // 为空时只在内存中统计
+
+	lock     sync.Mutex
+	month    string
+	counters map[string]*session.TrafficCounter
+}
+
+func trafficMonth(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+// loadTrafficStore 读取流量文件，文件不存在时从零开始，文件属于之前的月份时清零
+func loadTrafficStore(path string) (*trafficStore, error) {
+	t := &trafficStore{
+		path:     path,
+		month:    trafficMonth(time.Now()),
+		counters: make(map[string]*session.TrafficCounter),
+	}
+	if path == "" {
+		return t, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var f trafficFile
+	if err = json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if f.Month != t.month {
+		return t, nil
+	}
+	for name, usage := range f.Users {
+		c := new(session.TrafficCounter)
+		// 服务器的会话接收的是上行，发送的是下行
+		c.Store(usage.Download, usage.Upload)
+		t.counters[name] = c
+	}
+	return t, nil
+}
+
+// counter 返回用户的计数器，同一用户的所有会话共用一个
+func (t *trafficStore) counter(name string) *session.TrafficCounter {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	c, ok := t.counters[name]
+	if !ok {
+		c = new(session.TrafficCounter)
+		t.counters[name] = c
+	}
+	return c
+}
+
+// usage 返回用户当月的上行与下行字节数
+func (t *trafficStore) usage(name string) trafficUsage {
+	sent, received := t.counter(name).Load()
+	return trafficUsage{Upload: received, Download: sent}
+}
+
+// rollover 在进入新的月份时清零所有计数器，会话持有的计数器继续有效
+func (t *trafficStore) rollover(now time.Time) bool {
+	month := trafficMonth(now)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if month == t.month {
+		return false
+	}
+	t.month = month
+	for _, c := range t.counters {
+		c.Store(0, 0)
+	}
+	return true
+}
+
+// save 将计数写入流量文件，先写临时文件再改名，避免写到一半时退出损坏文件
+func (t *trafficStore) save() error {
+	if t.path == "" {
+		return nil
+	}
+	t.lock.Lock()
+	f := trafficFile{Month: t.month, Users: make(map[string]*trafficUsage, len(t.counters))}
+	for name, c := range t.counters {
+		sent, received := c.Load()
+		f.Users[name] = &trafficUsage{Upload: received, Download: sent}
+	}
+	t.lock.Unlock()
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := t.path + ".tmp"
+	err = os.WriteFile(tmp, b, 0o644)
+	if err == nil {
+		err = os.Rename(tmp, t.path)
+	}
+	return err
+}
+
+// stats 返回各用户当月的流量，用于定期输出
+func (t *trafficStore) stats() []string {
+	t.lock.Lock()
+	names := make([]string, 0, len(t.counters))
+	for name := range t.counters {
+		names = append(names, name)
+	}
+	t.lock.Unlock()
+	slices.Sort(names)
+
+	stats := make([]string, 0, len(names))
+	for _, name := range names {
+		u := t.usage(name)
+		stats = append(stats, fmt.Sprintf("%s up %s down %s", name, byteSize(u.Upload), byteSize(u.Download)))
+	}
+	return stats
+}
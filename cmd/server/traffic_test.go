@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for _, c := range []struct {
+		s    string
+		size byteSize
+	}{
+		{"0", 0},
+		{"512", 512},
+		{"1K", 1 << 10},
+		{"1KiB", 1 << 10},
+		{"1.5 MB", 3 << 19},
+		{"100GiB", 100 << 30},
+		{"2t", 2 << 40},
+	} {
+		if size, err := parseByteSize(c.s); err != nil || size != c.size {
+			t.Error(c.s, size, err)
+		}
+	}
+	for _, s := range []string{"", "GiB", "-1", "1PiB", "1 KB/s"} {
+		if size, err := parseByteSize(s); err == nil {
+			t.Error(s, "parsed as", size)
+		}
+	}
+	var size byteSize
+	if err := json.Unmarshal([]byte(`4096`), &size); err != nil || size != 4096 {
+		t.Fatal("number", size, err)
+	}
+	if err := json.Unmarshal([]byte(`true`), &size); err == nil {
+		t.Fatal("bool parsed as", size)
+	}
+}
+
+func TestTrafficStoreFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	traffic, err := loadTrafficStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 服务器发送的是下行，接收的是上行
+	traffic.counter("alice").Store(200, 100)
+	if u := traffic.usage("alice"); u.Upload != 100 || u.Download != 200 {
+		t.Fatalf("usage %+v", u)
+	}
+	if err = traffic.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 同一个月内重新启动时从文件恢复
+	traffic, err = loadTrafficStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := traffic.usage("alice"); u.Upload != 100 || u.Download != 200 {
+		t.Fatalf("restored usage %+v", u)
+	}
+
+	// 之前月份的文件不再计入
+	b, _ := json.Marshal(trafficFile{Month: "2000-01", Users: map[string]*trafficUsage{"alice": {Upload: 1, Download: 2}}})
+	if err = os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	traffic, err = loadTrafficStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := traffic.usage("alice"); u.Upload != 0 || u.Download != 0 {
+		t.Fatalf("usage of an old month %+v", u)
+	}
+
+	if err = os.WriteFile(path, []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = loadTrafficStore(path); err == nil {
+		t.Fatal("loaded a broken file")
+	}
+}
+
+func TestTrafficRollover(t *testing.T) {
+	traffic, _ := loadTrafficStore("")
+	c := traffic.counter("alice")
+	c.Store(10, 20)
+	now := time.Now()
+	if traffic.rollover(now) {
+		t.Fatal("rollover within the month")
+	}
+	next := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, now.Location())
+	if !traffic.rollover(next) || traffic.rollover(next) {
+		t.Fatal("no single rollover into the next month")
+	}
+	// 会话持有的计数器被清零后继续计数
+	if sent, received := c.Load(); sent != 0 || received != 0 {
+		t.Fatal("not reset", sent, received)
+	}
+	if traffic.counter("alice") != c {
+		t.Fatal("counter replaced")
+	}
+}
+
+func TestTrafficQuota(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUsers(t, path, `[{"name": "alice", "password": "a", "quota": "4KiB"}, {"name": "bob", "password": "b"}]`)
+	users, err := loadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _ := newTestServer(t, users)
+	target := startEchoServer(t)
+
+	cli := loginTestServer(t, server, "a")
+	if err = echo(openTestStream(t, cli, target), 1000); err != nil {
+		t.Fatal(err)
+	}
+	u := server.traffic.usage("alice")
+	if u.Upload < 1000 || u.Download != 1000 {
+		t.Fatalf("usage %+v", u)
+	}
+	if server.quotaExceeded("alice") {
+		t.Fatal("quota exceeded too early")
+	}
+
+	// 流量用完后，新的 Stream 收到错误，已有会话默认不关闭
+	if err = echo(openTestStream(t, cli, target), 2000); err != nil {
+		t.Fatal(err)
+	}
+	if !server.quotaExceeded("alice") {
+		t.Fatal("quota not exceeded", server.traffic.usage("alice"))
+	}
+	// 服务器在读取目标地址前就拒绝，客户端从读取中得到原因
+	stream, err := cli.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = stream.Read(make([]byte, 1))
+	if err == nil || !strings.Contains(err.Error(), errQuotaExceeded.Error()) {
+		t.Fatal("stream over quota:", err)
+	}
+	// 没有流量限制的用户不受影响
+	other := loginTestServer(t, server, "b")
+	if err = echo(openTestStream(t, other, target), 10000); err != nil {
+		t.Fatal(err)
+	}
+
+	server.quotaCloseSessions = true
+	server.accountTraffic()
+	waitSessions(t, server, 1)
+	if other.IsClosed() {
+		t.Fatal("session of a user without quota closed")
+	}
+
+	// 进入新的月份后流量清零，可以再次使用
+	server.traffic.lock.Lock()
+	server.traffic.month = "2000-01"
+	server.traffic.lock.Unlock()
+	server.accountTraffic()
+	if u := server.traffic.usage("alice"); u.Upload != 0 || u.Download != 0 {
+		t.Fatalf("usage after rollover %+v", u)
+	}
+	cli = loginTestServer(t, server, "a")
+	if err = echo(openTestStream(t, cli, target), 1000); err != nil {
+		t.Fatal("after rollover:", err)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"anytls/proxy/auth"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// user 是用户库中的一个用户
+type user struct {
+	Name     string    `json:"name"`
+	Password string    `json:"password"`
+	Enabled  *bool     `json:"enabled,omitempty"` // 缺省为启用
+	Expiry   time.Time `json:"expiry,omitzero"`   // 零值为永不过期
+	Quota    byteSize  `json:"quota,omitempty"`   // 每月上行与下行合计的流量，0 为不限
+	Limit    rateLimit `json:"limit,omitzero"`    // 用户所有会话合计的限速
+
+	passwordSha256 []byte
+}
+
+// valid 判断用户当前是否允许认证
+func (u *user) valid(now time.Time) bool {
+	if u.Enabled != nil && !*u.Enabled {
+		return false
+	}
+	return u.Expiry.IsZero() || now.Before(u.Expiry)
+}
+
+// userStore 按密码哈希查找用户，用户文件修改后可以重新加载
+type userStore struct {
+	path    string
+	modTime time.Time
+
+	lock   sync.RWMutex
+	users  []*user
+	byName map[string]*user
+	byID   map[[sha256.Size]byte]*user // sha256(sha256(password))，v2 认证
+}
+
+// newSingleUserStore 用于只设置了 -p 的单密码模式
+func newSingleUserStore(password string) *userStore {
+	s := &userStore{}
+	s.set([]*user{{Name: "default", Password: password}})
+	return s
+}
+
+// loadUserStore 读取 JSON 格式的用户文件：
+//
+//	[{"name": "alice", "password": "...", "enabled": true, "expiry": "2026-01-01T00:00:00Z", "quota": "100GiB", "limit": {"upload": "1MiB", "download": "10MiB"}}]
+func loadUserStore(path string) (*userStore, error) {
+	s := &userStore{path: path}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload 在用户文件修改后重新读取，文件有误时保留原有用户
+func (s *userStore) reload() (bool, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return false, nil
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return false, err
+	}
+	var users []*user
+	if err = json.Unmarshal(b, &users); err != nil {
+		return false, fmt.Errorf("%s: %w", s.path, err)
+	}
+	if err = s.set(users); err != nil {
+		return false, fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.modTime = info.ModTime()
+	return true, nil
+}
+
+func (s *userStore) set(users []*user) error {
+	byName := make(map[string]*user)
+	byID := make(map[[sha256.Size]byte]*user)
+	for _, u := range users {
+		if u.Name == "" || u.Password == "" {
+			return errors.New("user without name or password")
+		}
+		if _, ok := byName[u.Name]; ok {
+			return fmt.Errorf("duplicate user %q", u.Name)
+		}
+		hash := sha256.Sum256([]byte(u.Password))
+		id := [sha256.Size]byte(auth.ID(hash[:]))
+		if other, ok := byID[id]; ok {
+			return fmt.Errorf("users %q and %q have the same password", other.Name, u.Name)
+		}
+		u.passwordSha256 = hash[:]
+		byName[u.Name] = u
+		byID[id] = u
+	}
+	s.lock.Lock()
+	s.users, s.byName, s.byID = users, byName, byID
+	s.lock.Unlock()
+	return nil
+}
+
+// lookupV1 按 sha256(password) 查找用户。
+// v1 请求中的哈希本身就是凭据，用 map 查找的耗时会随命中的前缀变化，
+// 因此逐个用户做常数时间比较，且不提前退出
+func (s *userStore) lookupV1(hash []byte) *user {
+	if len(hash) != sha256.Size {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var found *user
+	for _, u := range s.users {
+		if subtle.ConstantTimeCompare(u.passwordSha256, hash) == 1 {
+			found = u
+		}
+	}
+	return found
+}
+
+// lookupV2 按 v2 认证请求中的 ID 查找用户，ID 不是凭据，
+// 请求随后还要通过 auth.VerifyV2 的常数时间校验，所以可以用 map 查找
+func (s *userStore) lookupV2(id []byte) *user {
+	if len(id) != sha256.Size {
+		return nil
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.byID[[sha256.Size]byte(id)]
+}
+
+// lookup 按用户名查找用户，用户文件重新加载后返回新的配置
+func (s *userStore) lookup(name string) *user {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.byName[name]
+}
+
+type userContextKey struct{}
+
+// contextWithUser 将认证的用户名附加到会话的 context
+func contextWithUser(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, userContextKey{}, name)
+}
+
+// userFromContext 返回会话所属的用户名
+func userFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(userContextKey{}).(string)
+	return name
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"anytls/proxy/auth"
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeUsers(t *testing.T, path, content string) {
+	t.Helper()
+	writeFileLater(t, path, []byte(content))
+}
+
+func passwordHash(password string) []byte {
+	hash := sha256.Sum256([]byte(password))
+	return hash[:]
+}
+
+func TestLoadUserStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUsers(t, path, `[
+		{"name": "alice", "password": "a", "quota": "100GiB", "limit": {"upload": "1MiB", "download": 2048}},
+		{"name": "bob", "password": "b", "enabled": false, "expiry": "2026-01-01T00:00:00Z"}
+	]`)
+	users, err := loadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := users.lookup("alice")
+	if alice == nil || alice.Quota != 100<<30 || alice.Limit.Upload != 1<<20 || alice.Limit.Download != 2048 {
+		t.Fatalf("alice %+v", alice)
+	}
+	bob := users.lookup("bob")
+	if bob == nil || bob.Enabled == nil || *bob.Enabled || !bob.Expiry.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("bob %+v", bob)
+	}
+	if users.lookup("carol") != nil {
+		t.Fatal("unknown user found")
+	}
+
+	// v1 按 sha256(password) 查找，v2 按其再做一次 sha256 的 ID 查找
+	if u := users.lookupV1(passwordHash("a")); u != alice {
+		t.Fatal("v1 lookup", u)
+	}
+	if u := users.lookupV2(auth.ID(passwordHash("b"))); u != bob {
+		t.Fatal("v2 lookup", u)
+	}
+	for _, hash := range [][]byte{passwordHash("c"), auth.ID(passwordHash("a")), passwordHash("a")[:16], nil} {
+		if users.lookupV1(hash) != nil {
+			t.Fatalf("v1 lookup of %x succeeded", hash)
+		}
+	}
+	if users.lookupV2(passwordHash("a")) != nil {
+		t.Fatal("v2 lookup by the v1 hash succeeded")
+	}
+}
+
+func TestLoadUserStoreInvalid(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		content string
+	}{
+		{"not json", `alice:a`},
+		{"no password", `[{"name": "alice"}]`},
+		{"no name", `[{"password": "a"}]`},
+		{"duplicate name", `[{"name": "alice", "password": "a"}, {"name": "alice", "password": "b"}]`},
+		{"same password", `[{"name": "alice", "password": "a"}, {"name": "bob", "password": "a"}]`},
+		{"bad quota", `[{"name": "alice", "password": "a", "quota": "lots"}]`},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.json")
+			writeUsers(t, path, c.content)
+			if _, err := loadUserStore(path); err == nil {
+				t.Fatal("loaded")
+			}
+		})
+	}
+	if _, err := loadUserStore(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Fatal("loaded a missing file")
+	}
+}
+
+func TestUserStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUsers(t, path, `[{"name": "alice", "password": "a"}]`)
+	users, err := loadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := users.reload(); changed || err != nil {
+		t.Fatal("reload of an unchanged file", changed, err)
+	}
+
+	writeUsers(t, path, `[{"name": "bob", "password": "b"}]`)
+	if changed, err := users.reload(); !changed || err != nil {
+		t.Fatal("reload", changed, err)
+	}
+	if users.lookup("alice") != nil || users.lookupV1(passwordHash("a")) != nil || users.lookupV2(auth.ID(passwordHash("a"))) != nil {
+		t.Fatal("removed user still found")
+	}
+	if users.lookup("bob") == nil || users.lookupV2(auth.ID(passwordHash("b"))) == nil {
+		t.Fatal("new user not found")
+	}
+
+	// 文件有误时保留原有用户，修正后再次加载
+	writeUsers(t, path, `[{"name": "carol"}]`)
+	if _, err := users.reload(); err == nil {
+		t.Fatal("reloaded an invalid file")
+	}
+	if users.lookup("bob") == nil || users.lookup("carol") != nil {
+		t.Fatal("users changed by an invalid file")
+	}
+	writeUsers(t, path, `[{"name": "carol", "password": "c"}]`)
+	if changed, err := users.reload(); !changed || err != nil || users.lookup("carol") == nil {
+		t.Fatal("reload after the fix", changed, err)
+	}
+}
+
+func TestUserValid(t *testing.T) {
+	now := time.Now()
+	enabled, disabled := true, false
+	for _, c := range []struct {
+		name  string
+		user  user
+		valid bool
+	}{
+		{"default", user{}, true},
+		{"enabled", user{Enabled: &enabled}, true},
+		{"disabled", user{Enabled: &disabled}, false},
+		{"not expired", user{Expiry: now.Add(time.Hour)}, true},
+		{"expired", user{Expiry: now.Add(-time.Hour)}, false},
+		{"disabled, not expired", user{Enabled: &disabled, Expiry: now.Add(time.Hour)}, false},
+	} {
+		if c.user.valid(now) != c.valid {
+			t.Error(c.name, "valid", !c.valid)
+		}
+	}
+}
+
+func TestAuthDisabledUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	writeUsers(t, path, `[
+		{"name": "alice", "password": "a"},
+		{"name": "bob", "password": "b", "enabled": false},
+		{"name": "carol", "password": "c", "expiry": "2000-01-01T00:00:00Z"}
+	]`)
+	users, err := loadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 已禁用或已过期的用户与密码错误一样交给 fallback
+	for _, password := range []string{"b", "c"} {
+		server, f := newTestServer(t, users)
+		loginTestServer(t, server, password)
+		select {
+		case <-f.at:
+		case <-time.After(5 * time.Second):
+			t.Fatal("user", password, "not rejected")
+		}
+	}
+
+	server, f := newTestServer(t, users)
+	cli := loginTestServer(t, server, "a")
+	waitSessions(t, server, 1)
+	select {
+	case <-f.at:
+		t.Fatal("valid user rejected")
+	default:
+	}
+
+	// 重新加载后，已禁用用户的会话被关闭
+	writeUsers(t, path, `[{"name": "alice", "password": "a", "enabled": false}]`)
+	server.reloadUsers()
+	waitSessions(t, server, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for !cli.IsClosed() {
+		if time.Now().After(deadline) {
+			t.Fatal("client session still open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -6,7 +6,11 @@ require (
 	github.com/chen3feng/stl4go v0.1.1
 	github.com/sagernet/sing v0.5.1
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.43.0
 	golang.org/x/net v0.46.0
 )
 
-require golang.org/x/sys v0.37.0 // indirect
+require (
+	golang.org/x/sys v0.37.0 // indirect
+	golang.org/x/text v0.30.0 // indirect
+)
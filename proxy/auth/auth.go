@@ -0,0 +1,120 @@
+// Package auth implements the authentication request a client sends right after the TLS handshake.
+//
+// Version 1 is the static sha256(password). Version 2 proves knowledge of it without revealing it:
+//
+//	| sha256(sha256(password)) | timestamp | nonce | HMAC-SHA256 |
+//	| 32 Bytes                 | 8 Bytes   | 16    | 32 Bytes    |
+//
+// The HMAC is keyed with sha256(password) and covers the TLS exporter keying material,
+// the timestamp and the nonce, so a captured request is useless on any other TLS connection.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// ExporterLabel is the TLS exporter label the HMAC is bound to
+	ExporterLabel = "EXPORTER-anytls-auth"
+	exporterLen   = 32
+
+	IDLen        = sha256.Size
+	nonceLen     = 16
+	macLen       = sha256.Size
+	RequestV2Len = IDLen + 8 + nonceLen + macLen
+
+	// MaxClockSkew is how far the timestamp of a request may be from the server's clock
+	MaxClockSkew = 2 * time.Minute
+)
+
+var (
+	ErrClockSkew = errors.New("auth: timestamp out of range")
+	ErrBadMAC    = errors.New("auth: bad mac")
+	ErrReplay    = errors.New("auth: replayed nonce")
+)
+
+// ID identifies a password in a version 2 request, it reveals nothing usable to authenticate
+func ID(passwordSha256 []byte) []byte {
+	sum := sha256.Sum256(passwordSha256)
+	return sum[:]
+}
+
+// Exporter returns the keying material of a TLS connection whose handshake is complete
+func Exporter(conn *tls.Conn) ([]byte, error) {
+	state := conn.ConnectionState()
+	return state.ExportKeyingMaterial(ExporterLabel, nil, exporterLen)
+}
+
+// NewRequestV2 builds a version 2 request for the TLS connection with the given exporter
+func NewRequestV2(passwordSha256, exporter []byte, now time.Time) []byte {
+	request := make([]byte, 0, RequestV2Len)
+	request = append(request, ID(passwordSha256)...)
+	request = binary.BigEndian.AppendUint64(request, uint64(now.Unix()))
+	nonce := make([]byte, nonceLen)
+	rand.Read(nonce)
+	request = append(request, nonce...)
+	return append(request, mac(passwordSha256, exporter, request[IDLen:])...)
+}
+
+// VerifyV2 checks the part of a version 2 request after the ID, in constant time.
+// A request that passes must still be checked against a ReplayCache.
+func VerifyV2(passwordSha256, exporter, body []byte, now time.Time) (nonce [nonceLen]byte, err error) {
+	if len(body) != RequestV2Len-IDLen {
+		return nonce, ErrBadMAC
+	}
+	if !hmac.Equal(mac(passwordSha256, exporter, body[:8+nonceLen]), body[8+nonceLen:]) {
+		return nonce, ErrBadMAC
+	}
+	ts := time.Unix(int64(binary.BigEndian.Uint64(body[:8])), 0)
+	if ts.Before(now.Add(-MaxClockSkew)) || ts.After(now.Add(MaxClockSkew)) {
+		return nonce, ErrClockSkew
+	}
+	copy(nonce[:], body[8:])
+	return nonce, nil
+}
+
+func mac(passwordSha256, exporter, timestampAndNonce []byte) []byte {
+	h := hmac.New(sha256.New, passwordSha256)
+	h.Write(exporter)
+	h.Write(timestampAndNonce)
+	return h.Sum(nil)
+}
+
+// ReplayCache remembers the nonces of accepted requests for as long as their timestamp is acceptable
+type ReplayCache struct {
+	lock      sync.Mutex
+	seen      map[[nonceLen]byte]time.Time
+	lastPrune time.Time
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{seen: make(map[[nonceLen]byte]time.Time)}
+}
+
+// Check records nonce and returns ErrReplay if it was already recorded
+func (c *ReplayCache) Check(nonce [nonceLen]byte, now time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if now.Sub(c.lastPrune) > MaxClockSkew {
+		for n, expire := range c.seen {
+			if now.After(expire) {
+				delete(c.seen, n)
+			}
+		}
+		c.lastPrune = now
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return ErrReplay
+	}
+	// a request older than twice the skew is refused by VerifyV2 anyway
+	c.seen[nonce] = now.Add(2 * MaxClockSkew)
+	return nil
+}
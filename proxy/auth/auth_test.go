@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"anytls/util"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// tlsPair returns the exporters both ends of a fresh TLS connection compute
+func tlsPair(t *testing.T) (client, server []byte) {
+	t.Helper()
+	cert, err := util.GenerateKeyPair(time.Now, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	clientConn := tls.Client(c1, &tls.Config{InsecureSkipVerify: true})
+	serverConn := tls.Server(c2, &tls.Config{Certificates: []tls.Certificate{*cert}})
+	errc := make(chan error, 1)
+	go func() { errc <- serverConn.Handshake() }()
+	if err := clientConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if client, err = Exporter(clientConn); err != nil {
+		t.Fatal(err)
+	}
+	if server, err = Exporter(serverConn); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestVerifyV2(t *testing.T) {
+	password := sha256.Sum256([]byte("password"))
+	clientExporter, serverExporter := tlsPair(t)
+	_, otherExporter := tlsPair(t)
+	if !bytes.Equal(clientExporter, serverExporter) || bytes.Equal(serverExporter, otherExporter) {
+		t.Fatal("exporters are not bound to the connection")
+	}
+	now := time.Now()
+	request := NewRequestV2(password[:], clientExporter, now)
+	if len(request) != RequestV2Len || !bytes.Equal(request[:IDLen], ID(password[:])) {
+		t.Fatal("malformed request")
+	}
+
+	// withTimestamp signs the request again with another timestamp
+	withTimestamp := func(ts time.Time) []byte {
+		body := bytes.Clone(request[IDLen : IDLen+8+nonceLen])
+		binary.BigEndian.PutUint64(body, uint64(ts.Unix()))
+		return append(body, mac(password[:], clientExporter, body)...)
+	}
+	wrongPassword := sha256.Sum256([]byte("wrong"))
+	tampered := bytes.Clone(request[IDLen:])
+	tampered[len(tampered)-1] ^= 1
+
+	for _, test := range []struct {
+		name     string
+		password []byte
+		exporter []byte
+		body     []byte
+		err      error
+	}{
+		{"valid", password[:], serverExporter, request[IDLen:], nil},
+		{"wrong password", wrongPassword[:], serverExporter, request[IDLen:], ErrBadMAC},
+		{"tampered mac", password[:], serverExporter, tampered, ErrBadMAC},
+		{"short", password[:], serverExporter, request[IDLen : RequestV2Len-1], ErrBadMAC},
+		{"other connection", password[:], otherExporter, request[IDLen:], ErrBadMAC},
+		{"within skew", password[:], serverExporter, withTimestamp(now.Add(MaxClockSkew - time.Second)), nil},
+		{"too old", password[:], serverExporter, withTimestamp(now.Add(-MaxClockSkew - time.Second)), ErrClockSkew},
+		{"too new", password[:], serverExporter, withTimestamp(now.Add(MaxClockSkew + time.Second)), ErrClockSkew},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := VerifyV2(test.password, test.exporter, test.body, now); !errors.Is(err, test.err) {
+				t.Fatal("got", err, "want", test.err)
+			}
+		})
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	password := sha256.Sum256([]byte("password"))
+	exporter, _ := tlsPair(t)
+	now := time.Now()
+	cache := NewReplayCache()
+
+	request := NewRequestV2(password[:], exporter, now)
+	nonce, err := VerifyV2(password[:], exporter, request[IDLen:], now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Check(nonce, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Check(nonce, now.Add(time.Second)); err != ErrReplay {
+		t.Fatal("replayed nonce accepted:", err)
+	}
+
+	// another request gets another nonce
+	other, err := VerifyV2(password[:], exporter, NewRequestV2(password[:], exporter, now)[IDLen:], now)
+	if err != nil || other == nonce {
+		t.Fatal("nonce reused", err)
+	}
+	if err := cache.Check(other, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// nonces are forgotten only once their timestamp would be refused, pruning may lag by MaxClockSkew
+	if err := cache.Check(nonce, now.Add(2*MaxClockSkew-time.Second)); err != ErrReplay {
+		t.Fatal("nonce forgotten too early:", err)
+	}
+	if err := cache.Check(nonce, now.Add(4*MaxClockSkew)); err != nil {
+		t.Fatal("expired nonce kept:", err)
+	}
+}
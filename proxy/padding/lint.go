@@ -0,0 +1,129 @@
+package padding
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SchemeError is a problem found on a line of a padding scheme
+type SchemeError struct {
+	// Line is 1-based, 0 for problems of the scheme as a whole
+	Line int
+	// Warning is set for problems that do not change how the scheme is applied
+	Warning bool
+	Err     error
+}
+
+func (e *SchemeError) Error() string {
+	var prefix string
+	if e.Warning {
+		prefix = "warning: "
+	}
+	if e.Line == 0 {
+		return prefix + e.Err.Error()
+	}
+	return fmt.Sprintf("%sline %d: %s", prefix, e.Line, e.Err)
+}
+
+// CheckPaddingScheme reports every problem of rawScheme with its line.
+// Lines are read the same way as NewPaddingFactory does, which rejects the scheme
+// if any non-warning problem is on the version, stop or loop key and ignores the others.
+func CheckPaddingScheme(rawScheme []byte) (problems []*SchemeError) {
+	report := func(line int, warning bool, err error) {
+		problems = append(problems, &SchemeError{Line: line, Warning: warning, Err: err})
+	}
+
+	keyLines := make(map[string]int)
+	lines := strings.Split(string(rawScheme), "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		k, _, found := strings.Cut(line, "=")
+		if !found {
+			report(i+1, false, errors.New("missing `=`, line is ignored"))
+			continue
+		}
+		if prev, ok := keyLines[k]; ok {
+			report(i+1, true, fmt.Errorf("%q is already set on line %d, this line wins", k, prev))
+		}
+		keyLines[k] = i + 1
+	}
+
+	scheme := make(map[string]string)
+	for k, line := range keyLines {
+		_, scheme[k], _ = strings.Cut(lines[line-1], "=")
+	}
+
+	version := 1
+	if line, ok := keyLines["version"]; ok {
+		v, err := strconv.Atoi(scheme["version"])
+		if err != nil || v < 1 || v > SchemeVersion {
+			report(line, false, fmt.Errorf("unsupported version %q, want 1-%d", scheme["version"], SchemeVersion))
+		} else {
+			version = v
+		}
+	}
+
+	var stop uint32
+	stopOK := false
+	if line, ok := keyLines["stop"]; !ok {
+		report(0, false, errors.New("missing `stop`"))
+	} else if v, err := strconv.Atoi(scheme["stop"]); err != nil {
+		report(line, false, fmt.Errorf("bad stop %q", scheme["stop"]))
+	} else {
+		stop, stopOK = uint32(v), true
+	}
+
+	if line := keyLines["stop"]; stopOK && version >= 2 && stop > maxCompatiblePackets {
+		report(line, true, fmt.Errorf("version 1 clients are only padded up to packet %d", maxCompatiblePackets))
+	}
+
+	if line, ok := keyLines["loop"]; ok && version < 2 {
+		report(line, true, errors.New("loop needs version=2, line is ignored"))
+	} else if ok {
+		first, last, err := parseLoop(scheme["loop"])
+		if err != nil {
+			report(line, false, err)
+		} else {
+			if stopOK && last >= stop {
+				report(line, true, fmt.Errorf("loop ends at %d but stop is %d, it never repeats", last, stop))
+			}
+			for pkt := first; pkt <= last; pkt++ {
+				if _, ok := keyLines[strconv.Itoa(int(pkt))]; !ok {
+					report(line, true, fmt.Errorf("packet %d of the loop is not defined", pkt))
+				}
+			}
+		}
+	}
+
+	for k, line := range keyLines {
+		if k == "version" || k == "stop" || k == "loop" {
+			continue
+		}
+		pkt, err := strconv.ParseUint(k, 10, 32)
+		if err != nil {
+			report(line, false, fmt.Errorf("unknown key %q, line is ignored", k))
+			continue
+		}
+		if stopOK && uint32(pkt) >= stop {
+			report(line, true, fmt.Errorf("packet %d is at or after stop=%d, it is never used", pkt, stop))
+		}
+		_, errs := parsePacket(scheme[k], version)
+		for _, err := range errs {
+			report(line, false, fmt.Errorf("%w, element is ignored", err))
+		}
+		if pkt == 0 && len(splitElements(scheme[k])) > 1 {
+			report(line, true, errors.New("packet 0 is the authentication, only its first size is used"))
+		}
+	}
+
+	slices.SortStableFunc(problems, func(a, b *SchemeError) int {
+		return cmp.Compare(a.Line, b.Line)
+	})
+	return
+}
@@ -3,11 +3,10 @@ package padding
 import (
 	"anytls/util"
 	"crypto/md5"
-	"crypto/rand"
 	"fmt"
-	"math/big"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/sagernet/sing/common/atomic"
 )
@@ -22,12 +21,25 @@ var defaultPaddingScheme = []byte(`stop=5
 4=200-1200`)
 
 type PaddingFactory struct {
-	scheme    util.StringMap
+	packets   map[uint32][]recordSpec
 	RawScheme []byte
 	Stop      uint32
 	Md5       string
+	// Version is the `version` key of the scheme, 1 if absent
+	Version int
+	// packets after LoopLast repeat LoopFirst to LoopLast, 0 if the scheme has no loop
+	LoopFirst, LoopLast uint32
+
+	compatible *PaddingFactory
 }
 
+// SchemeVersion is the newest scheme version this implementation understands
+const SchemeVersion = 2
+
+// maxCompatiblePackets bounds the packets of the scheme derived for version 1 clients,
+// the packets after it and the unrolled loops are not padded for them
+const maxCompatiblePackets = 256
+
 var DefaultPaddingFactory atomic.TypedValue[*PaddingFactory]
 
 func init() {
@@ -46,6 +58,8 @@ func NewPaddingFactory(rawScheme []byte) *PaddingFactory {
 	p := &PaddingFactory{
 		RawScheme: rawScheme,
 		Md5:       fmt.Sprintf("%x", md5.Sum(rawScheme)),
+		Version:   1,
+		packets:   make(map[uint32][]recordSpec),
 	}
 	scheme := util.StringMapFromBytes(rawScheme)
 	if len(scheme) == 0 {
@@ -56,38 +70,127 @@ func NewPaddingFactory(rawScheme []byte) *PaddingFactory {
 	} else {
 		return nil
 	}
-	p.scheme = scheme
+	if v, ok := scheme["version"]; ok {
+		version, err := strconv.Atoi(v)
+		if err != nil || version < 1 || version > SchemeVersion {
+			return nil
+		}
+		p.Version = version
+	}
+	// version 1 has no loop, like its elements the key is ignored
+	if v, ok := scheme["loop"]; ok && p.Version >= 2 {
+		first, last, err := parseLoop(v)
+		if err != nil {
+			return nil
+		}
+		p.LoopFirst, p.LoopLast = first, last
+	}
+	for k, v := range scheme {
+		pkt, err := strconv.ParseUint(k, 10, 32)
+		if err != nil {
+			continue
+		}
+		// like version 1, elements that cannot be parsed are ignored
+		p.packets[uint32(pkt)], _ = parsePacket(v, p.Version)
+	}
+	if p.Version >= 2 {
+		p.compatible = NewPaddingFactory(p.compatibleScheme())
+	}
 	return p
 }
 
+// Compatible returns the scheme for clients that only understand version 1:
+// distributions become ranges, delays are dropped and repetitions and loops are unrolled.
+func (p *PaddingFactory) Compatible() *PaddingFactory {
+	if p.compatible != nil {
+		return p.compatible
+	}
+	return p
+}
+
+func (p *PaddingFactory) compatibleScheme() []byte {
+	stop := min(p.Stop, maxCompatiblePackets)
+	lines := []string{"stop=" + strconv.Itoa(int(stop))}
+	for pkt := range stop {
+		specs := p.packet(pkt)
+		if len(specs) == 0 {
+			continue
+		}
+		elements := make([]string, 0, len(specs))
+		for _, spec := range specs {
+			if spec.size == nil {
+				elements = append(elements, "c")
+			} else {
+				_min, _max := spec.size.bounds()
+				elements = append(elements, strconv.Itoa(_min)+"-"+strconv.Itoa(_max))
+			}
+		}
+		lines = append(lines, strconv.Itoa(int(pkt))+"="+strings.Join(elements, ","))
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// packet returns the pattern of a packet, following the loop
+func (p *PaddingFactory) packet(pkt uint32) []recordSpec {
+	if p.LoopLast > 0 && pkt > p.LoopLast {
+		pkt = p.LoopFirst + (pkt-p.LoopFirst)%(p.LoopLast-p.LoopFirst+1)
+	}
+	return p.packets[pkt]
+}
+
+// GenerateRecords returns the records of packet pkt, including delays and check marks
+func (p *PaddingFactory) GenerateRecords(pkt uint32) (records []Record) {
+	for _, spec := range p.packet(pkt) {
+		records = append(records, spec.generate())
+	}
+	return
+}
+
 func (p *PaddingFactory) GenerateRecordPayloadSizes(pkt uint32) (pktSizes []int) {
-	if s, ok := p.scheme[strconv.Itoa(int(pkt))]; ok {
-		sRanges := strings.Split(s, ",")
-		for _, sRange := range sRanges {
-			sRangeMinMax := strings.Split(sRange, "-")
-			if len(sRangeMinMax) == 2 {
-				_min, err := strconv.ParseInt(sRangeMinMax[0], 10, 64)
-				if err != nil {
-					continue
-				}
-				_max, err := strconv.ParseInt(sRangeMinMax[1], 10, 64)
-				if err != nil {
-					continue
-				}
-				_min, _max = min(_min, _max), max(_min, _max)
-				if _min <= 0 || _max <= 0 {
-					continue
+	for _, record := range p.GenerateRecords(pkt) {
+		pktSizes = append(pktSizes, record.Size)
+	}
+	return
+}
+
+// Write is one connection write of a padded packet: Payload bytes of data followed by
+// a padding frame of Padding bytes, header included, sent after waiting Delay
+type Write struct {
+	Delay   time.Duration
+	Payload int
+	Padding int
+}
+
+// SplitPacket splits the payload of packet pkt into the writes its records ask for.
+// headerSize is the size of the frame header that carries the padding. Payload left
+// after the records, or all of it once pkt reaches Stop, goes in a last unpadded write.
+func (p *PaddingFactory) SplitPacket(pkt uint32, payload, headerSize int) (writes []Write) {
+	if pkt < p.Stop {
+		for _, record := range p.GenerateRecords(pkt) {
+			l := record.Size
+			if l == CheckMark {
+				if payload == 0 {
+					break
 				}
-				if _min == _max {
-					pktSizes = append(pktSizes, int(_min))
-				} else {
-					i, _ := rand.Int(rand.Reader, big.NewInt(_max-_min))
-					pktSizes = append(pktSizes, int(i.Int64()+_min))
+				continue
+			}
+			w := Write{Delay: record.Delay}
+			if payload > l { // this write is all payload
+				w.Payload = l
+			} else if payload > 0 { // this write contains the last part of payload and padding
+				w.Payload = payload
+				if paddingLen := l - payload - headerSize; paddingLen > 0 {
+					w.Padding = headerSize + paddingLen
 				}
-			} else if sRange == "c" {
-				pktSizes = append(pktSizes, CheckMark)
+			} else { // this write is all padding
+				w.Padding = headerSize + l
 			}
+			payload -= w.Payload
+			writes = append(writes, w)
 		}
 	}
+	if payload > 0 {
+		writes = append(writes, Write{Payload: payload})
+	}
 	return
 }
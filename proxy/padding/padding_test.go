@@ -0,0 +1,214 @@
+package padding
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePacket(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		// want describes the records: a size range "min-max", "c", with "+delay" if delayed
+		want []string
+		errs int
+	}{
+		{"100-300", []string{"100-300"}, 0},
+		{"300-100", []string{"100-300"}, 0},
+		{"500", []string{"500-500"}, 0},
+		{"20-50,c,200-1200", []string{"20-50", "c", "200-1200"}, 0},
+		{" 20-50 , c ", []string{"20-50", "c"}, 0},
+		{"100*3", []string{"100-100", "100-100", "100-100"}, 0},
+		{"c*2", []string{"c", "c"}, 0},
+		{"normal(1000,100)", []string{"800-1200"}, 0},
+		{"exp(100)", []string{"1-300"}, 0},
+		{"fixed(100,1400,600)", []string{"100-1400"}, 0},
+		{"delay(10-20),100", []string{"100-100+delay"}, 0},
+		{"delay(10),c,100,200", []string{"c", "100-100+delay", "200-200"}, 0},
+		{"normal(100000,1)", []string{"65535-65535"}, 0},
+
+		// invalid elements are skipped, the rest of the line applies
+		{"", nil, 1},
+		{"abc,100", []string{"100-100"}, 1},
+		{"0-100", nil, 1},
+		{"100-70000", nil, 1},
+		{"100*0,200", []string{"200-200"}, 1},
+		{"100*x", nil, 1},
+		{"normal(100)", nil, 1},
+		{"normal(-1,10)", nil, 1},
+		{"exp(0)", nil, 1},
+		{"fixed()", nil, 1},
+		{"fixed(1.5)", nil, 1},
+		{"fixed(70000)", nil, 1},
+		{"uniform(1,2)", nil, 1},
+		{"delay(10)*2,100", []string{"100-100"}, 1},
+		{"100,delay(10)", []string{"100-100"}, 1},
+		{"delay(x),100", []string{"100-100"}, 1},
+	} {
+		t.Run(test.line, func(t *testing.T) {
+			specs, errs := parsePacket(test.line, 2)
+			if len(errs) != test.errs {
+				t.Fatal("errors", errs, "want", test.errs)
+			}
+			if got := describeSpecs(specs); strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Fatal("got", got, "want", test.want)
+			}
+		})
+	}
+}
+
+// describeSpecs describes the records like the want of TestParsePacket
+func describeSpecs(specs []recordSpec) (got []string) {
+	for _, spec := range specs {
+		if spec.size == nil {
+			got = append(got, "c")
+			continue
+		}
+		_min, _max := spec.size.bounds()
+		s := strconv.Itoa(_min) + "-" + strconv.Itoa(_max)
+		if spec.delay != nil {
+			s += "+delay"
+		}
+		got = append(got, s)
+	}
+	return
+}
+
+func TestParsePacketVersion1(t *testing.T) {
+	// version 1 only has ranges and check marks, the other elements are skipped
+	for _, test := range []struct {
+		line string
+		want []string
+		errs int
+	}{
+		{"100-300,c,200-1200", []string{"100-300", "c", "200-1200"}, 0},
+		{"500", nil, 1},
+		{"500,100-200", []string{"100-200"}, 1},
+		{"100-200*3", nil, 1},
+		{"normal(1000,100),exp(100),fixed(100)", nil, 3},
+		{"delay(10),100-200", []string{"100-200"}, 1},
+	} {
+		t.Run(test.line, func(t *testing.T) {
+			specs, errs := parsePacket(test.line, 1)
+			if len(errs) != test.errs {
+				t.Fatal("errors", errs, "want", test.errs)
+			}
+			if got := describeSpecs(specs); strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Fatal("got", got, "want", test.want)
+			}
+		})
+	}
+
+	p := NewPaddingFactory([]byte("stop=10\nloop=1-2\n1=500\n2=normal(500,50),100-200"))
+	if p == nil || p.LoopLast != 0 || len(p.packets[1]) != 0 || len(p.packets[2]) != 1 {
+		t.Fatal("version 1 scheme with version 2 elements", p)
+	}
+	problems := CheckPaddingScheme(p.RawScheme)
+	if len(problems) != 3 || !problems[0].Warning || problems[1].Warning || problems[2].Warning {
+		t.Fatal("problems", problems)
+	}
+}
+
+func TestNewPaddingFactory(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		scheme string
+		valid  bool
+	}{
+		{"default", string(defaultPaddingScheme), true},
+		{"version 2", "version=2\nstop=3\n0=100\n1=normal(500,50)\n2=delay(5),c,100", true},
+		{"loop", "version=2\nstop=10\nloop=1-2\n1=100\n2=200", true},
+		{"empty", "", false},
+		{"no stop", "0=100", false},
+		{"bad stop", "stop=x\n0=100", false},
+		{"bad version", "version=3\nstop=1", false},
+		{"bad loop", "version=2\nstop=10\nloop=2-1", false},
+		{"bad packet is ignored", "stop=2\n1=abc", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if p := NewPaddingFactory([]byte(test.scheme)); (p != nil) != test.valid {
+				t.Fatal("valid", p != nil, "want", test.valid)
+			}
+		})
+	}
+}
+
+func TestCompatible(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		scheme string
+		want   string
+	}{
+		{
+			"version 1 is kept",
+			string(defaultPaddingScheme),
+			string(defaultPaddingScheme),
+		},
+		{
+			"distributions and delays",
+			"version=2\nstop=4\n0=100-200\n1=normal(1000,100)\n2=delay(10-20),exp(100),c\n3=fixed(50,150)*2",
+			"stop=4\n0=100-200\n1=800-1200\n2=1-300,c\n3=50-150,50-150",
+		},
+		{
+			"loop is unrolled",
+			"version=2\nstop=6\nloop=2-3\n1=100\n2=200\n3=300",
+			"stop=6\n1=100-100\n2=200-200\n3=300-300\n4=200-200\n5=300-300",
+		},
+		{
+			"stop is clamped without a loop",
+			"version=2\nstop=100000\n1=100\n300=300",
+			"stop=256\n1=100-100",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewPaddingFactory([]byte(test.scheme))
+			if p == nil {
+				t.Fatal("invalid scheme")
+			}
+			got := p.Compatible()
+			if string(got.RawScheme) != test.want {
+				t.Fatalf("got\n%s\nwant\n%s", got.RawScheme, test.want)
+			}
+			if got.Version != 1 || got.Stop > maxCompatiblePackets && p.Version >= 2 {
+				t.Fatal("version", got.Version, "stop", got.Stop)
+			}
+		})
+	}
+
+	// a loop reaching past the bound is cut there
+	p := NewPaddingFactory([]byte("version=2\nstop=1000000\nloop=1-1\n1=100"))
+	if c := p.Compatible(); c.Stop != maxCompatiblePackets || len(c.packets) != maxCompatiblePackets-1 {
+		t.Fatal("stop", c.Stop, "packets", len(c.packets))
+	}
+}
+
+func TestSplitPacket(t *testing.T) {
+	const headerSize = 7
+	p := NewPaddingFactory([]byte("version=2\nstop=3\n1=delay(10),100,c,50\n2=30"))
+	if p == nil {
+		t.Fatal("scheme rejected")
+	}
+	for _, test := range []struct {
+		pkt     uint32
+		payload int
+		want    []Write
+	}{
+		// payload beyond the records goes in a last unpadded write
+		{1, 250, []Write{{10 * time.Millisecond, 100, 0}, {0, 50, 0}, {0, 100, 0}}},
+		// the last part of the payload is padded up to the record size, the check mark ends the packet
+		{1, 60, []Write{{10 * time.Millisecond, 60, 40}}},
+		// no room left for a padding frame
+		{1, 95, []Write{{10 * time.Millisecond, 95, 0}}},
+		{1, 0, []Write{{10 * time.Millisecond, 0, headerSize + 100}}},
+		{2, 0, []Write{{0, 0, headerSize + 30}}},
+		// packets from stop on are not padded
+		{3, 10, []Write{{0, 10, 0}}},
+		{3, 0, nil},
+	} {
+		if got := p.SplitPacket(test.pkt, test.payload, headerSize); !slices.Equal(got, test.want) {
+			t.Errorf("packet %d payload %d: got %v, want %v", test.pkt, test.payload, got, test.want)
+		}
+	}
+}
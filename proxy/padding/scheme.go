@@ -0,0 +1,292 @@
+package padding
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	mrand "math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxRecordSize bounds sampled sizes, a cmdWaste frame cannot carry more
+const maxRecordSize = math.MaxUint16
+
+// Record is one TLS record of a padded packet
+type Record struct {
+	// Size is the payload size of the record, or CheckMark
+	Size int
+	// Delay is how long to wait before sending the record
+	Delay time.Duration
+}
+
+// sizeDist draws record sizes
+type sizeDist interface {
+	sample() int
+	// bounds is the uniform range approximating the distribution for version 1 schemes
+	bounds() (int, int)
+}
+
+type uniformDist struct {
+	min, max int
+}
+
+func (d uniformDist) sample() int {
+	if d.min == d.max {
+		return d.min
+	}
+	i, _ := rand.Int(rand.Reader, big.NewInt(int64(d.max-d.min)))
+	return int(i.Int64()) + d.min
+}
+
+func (d uniformDist) bounds() (int, int) {
+	return d.min, d.max
+}
+
+type normalDist struct {
+	mean, stddev float64
+}
+
+func (d normalDist) sample() int {
+	return clampSize(d.mean + mrand.NormFloat64()*d.stddev)
+}
+
+func (d normalDist) bounds() (int, int) {
+	return clampSize(d.mean - 2*d.stddev), clampSize(d.mean + 2*d.stddev)
+}
+
+type expDist struct {
+	mean float64
+}
+
+func (d expDist) sample() int {
+	return clampSize(mrand.ExpFloat64() * d.mean)
+}
+
+func (d expDist) bounds() (int, int) {
+	return 1, clampSize(3 * d.mean)
+}
+
+type fixedDist struct {
+	sizes []int
+}
+
+func (d fixedDist) sample() int {
+	return d.sizes[mrand.N(len(d.sizes))]
+}
+
+func (d fixedDist) bounds() (int, int) {
+	_min, _max := d.sizes[0], d.sizes[0]
+	for _, size := range d.sizes[1:] {
+		_min, _max = min(_min, size), max(_max, size)
+	}
+	return _min, _max
+}
+
+func clampSize(f float64) int {
+	return int(min(max(f, 1), maxRecordSize))
+}
+
+// recordSpec is one element of a packet's pattern, either a sized record or a check mark
+type recordSpec struct {
+	size  sizeDist
+	delay *uniformDist // milliseconds, nil for none
+}
+
+func (r recordSpec) generate() Record {
+	if r.size == nil {
+		return Record{Size: CheckMark}
+	}
+	record := Record{Size: r.size.sample()}
+	if r.delay != nil {
+		record.Delay = time.Duration(r.delay.sample()) * time.Millisecond
+	}
+	return record
+}
+
+// parsePacket parses the value of a packet line of a scheme of the given version.
+// Elements that fail to parse are reported and skipped, so that the rest of the packet still applies.
+// Version 1 only has `min-max` and `c`, the other elements are skipped like version 1 parsers do.
+func parsePacket(s string, version int) (specs []recordSpec, errs []error) {
+	var delay *uniformDist
+	for _, element := range splitElements(s) {
+		element = strings.TrimSpace(element)
+		if version < 2 && !isVersion1Element(element) {
+			errs = append(errs, fmt.Errorf("%q needs version=2", element))
+			continue
+		}
+		repeat := 1
+		if i := strings.LastIndexByte(element, '*'); i >= 0 {
+			n, err := strconv.Atoi(element[i+1:])
+			if err != nil || n < 1 {
+				errs = append(errs, fmt.Errorf("%q: bad repetition count", element))
+				continue
+			}
+			element, repeat = element[:i], n
+		}
+		if name, args, ok := parseCall(element); ok && name == "delay" {
+			d, err := parseRange(args)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%q: %w", element, err))
+				continue
+			}
+			if repeat != 1 {
+				errs = append(errs, fmt.Errorf("%q: delay cannot be repeated", element))
+				continue
+			}
+			delay = &d
+			continue
+		}
+		var spec recordSpec
+		if element != "c" {
+			size, err := parseSize(element)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%q: %w", element, err))
+				continue
+			}
+			spec.size = size
+			// a pending delay belongs to the next sized record, check marks pass it on
+			spec.delay, delay = delay, nil
+		}
+		for range repeat {
+			specs = append(specs, spec)
+		}
+	}
+	if delay != nil {
+		errs = append(errs, errors.New("delay is not followed by a record"))
+	}
+	return
+}
+
+func parseSize(element string) (sizeDist, error) {
+	name, args, ok := parseCall(element)
+	if !ok {
+		d, err := parseRange(element)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	params, err := parseNumbers(args)
+	if err != nil {
+		return nil, err
+	}
+	switch name {
+	case "normal":
+		if len(params) != 2 || params[0] <= 0 || params[1] < 0 {
+			return nil, errors.New("want normal(mean,stddev)")
+		}
+		return normalDist{mean: params[0], stddev: params[1]}, nil
+	case "exp":
+		if len(params) != 1 || params[0] <= 0 {
+			return nil, errors.New("want exp(mean)")
+		}
+		return expDist{mean: params[0]}, nil
+	case "fixed":
+		if len(params) == 0 {
+			return nil, errors.New("want fixed(size,...)")
+		}
+		d := fixedDist{}
+		for _, param := range params {
+			if param <= 0 || param > maxRecordSize || param != math.Trunc(param) {
+				return nil, fmt.Errorf("bad size %v", param)
+			}
+			d.sizes = append(d.sizes, int(param))
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("unknown distribution %q", name)
+	}
+}
+
+// parseRange parses `min-max` or a single number
+func parseRange(s string) (uniformDist, error) {
+	sMin, sMax, found := strings.Cut(s, "-")
+	if !found {
+		sMax = sMin
+	}
+	_min, err := strconv.ParseInt(strings.TrimSpace(sMin), 10, 64)
+	if err != nil {
+		return uniformDist{}, errors.New("bad range")
+	}
+	_max, err := strconv.ParseInt(strings.TrimSpace(sMax), 10, 64)
+	if err != nil {
+		return uniformDist{}, errors.New("bad range")
+	}
+	_min, _max = min(_min, _max), max(_min, _max)
+	if _min <= 0 || _max > maxRecordSize {
+		return uniformDist{}, errors.New("range out of bounds")
+	}
+	return uniformDist{min: int(_min), max: int(_max)}, nil
+}
+
+// isVersion1Element reports whether the parser before version 2 understood element
+func isVersion1Element(element string) bool {
+	if element == "c" {
+		return true
+	}
+	sMin, sMax, found := strings.Cut(element, "-")
+	if !found {
+		return false
+	}
+	_min, err1 := strconv.ParseInt(sMin, 10, 64)
+	_max, err2 := strconv.ParseInt(sMax, 10, 64)
+	return err1 == nil && err2 == nil && _min > 0 && _max > 0
+}
+
+func parseNumbers(s string) ([]float64, error) {
+	var numbers []float64
+	for _, field := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("bad number %q", field)
+		}
+		numbers = append(numbers, f)
+	}
+	return numbers, nil
+}
+
+// parseCall splits `name(args)`
+func parseCall(element string) (name, args string, ok bool) {
+	open := strings.IndexByte(element, '(')
+	if open <= 0 || !strings.HasSuffix(element, ")") {
+		return "", "", false
+	}
+	return element[:open], element[open+1 : len(element)-1], true
+}
+
+// splitElements splits on commas that are not inside parentheses
+func splitElements(s string) (elements []string) {
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				elements = append(elements, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(elements, s[start:])
+}
+
+// parseLoop parses `first-last`, the packets after last repeat first to last until stop
+func parseLoop(s string) (first, last uint32, err error) {
+	sFirst, sLast, found := strings.Cut(s, "-")
+	if !found {
+		return 0, 0, errors.New("want loop=first-last")
+	}
+	a, err1 := strconv.ParseUint(strings.TrimSpace(sFirst), 10, 32)
+	b, err2 := strconv.ParseUint(strings.TrimSpace(sLast), 10, 32)
+	if err1 != nil || err2 != nil || a < 1 || a > b {
+		return 0, 0, errors.New("want loop=first-last with 1 <= first <= last")
+	}
+	return uint32(a), uint32(b), nil
+}
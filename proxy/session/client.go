@@ -4,9 +4,11 @@ import (
 	"anytls/proxy/padding"
 	"anytls/util"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
+	"math/rand/v2"
 	"net"
 	"os"
 	"sync"
@@ -33,19 +35,56 @@ type Client struct {
 	sessions     map[uint64]*Session
 	sessionsLock sync.Mutex
 
-	padding *atomic.TypedValue[*padding.PaddingFactory]
+	// padding is owned by the Client, schemes pushed by the server are stored here
+	padding atomic.TypedValue[*padding.PaddingFactory]
 
 	idleSessionTimeout time.Duration
 	minIdleSession     int
+
+	heartbeat    HeartbeatConfig
+	idlePolicy   IdlePolicy
+	rotation     RotationPolicy
+	maxFrameSize int
+
+	expectServerPadding string
+	paddingFile         string
+	paddingFileLock     sync.Mutex
+}
+
+// RotationPolicy retires sessions, so that no connection lives or carries traffic for too long.
+// A retired session takes no new streams and is closed once its streams are done.
+// Zero values disable the corresponding limit.
+type RotationPolicy struct {
+	// MaxLifetime is how long a session may be used after it was dialed,
+	// plus a random duration up to LifetimeJitter.
+	MaxLifetime    time.Duration
+	LifetimeJitter time.Duration
+	// MaxStreams is how many streams may be opened on a session.
+	MaxStreams uint32
+	// MaxBytes is how many payload bytes, both directions together, a session may carry.
+	MaxBytes uint64
+}
+
+// IdlePolicy decides whether an idle session is still fit for reuse
+type IdlePolicy struct {
+	// ProbeAfter is how long a session may have received nothing before it is pinged on reuse.
+	// Zero disables probing.
+	ProbeAfter time.Duration
+	// ProbeTimeout bounds the ping, it defaults to 4*RTT but at least one second.
+	ProbeTimeout time.Duration
+	// MaxIdleAge is how long a session may sit in the pool before it must be dialed again.
+	// Zero disables the limit.
+	MaxIdleAge time.Duration
 }
 
+// NewClient creates a Client whose sessions pad with the scheme currently in _padding.
+// The Client keeps its own copy, schemes pushed by the server replace the copy and leave _padding unchanged.
 func NewClient(ctx context.Context, dialOut util.DialOutFunc,
 	_padding *atomic.TypedValue[*padding.PaddingFactory], idleSessionCheckInterval, idleSessionTimeout time.Duration, minIdleSession int,
 ) *Client {
 	c := &Client{
 		sessions:           make(map[uint64]*Session),
 		dialOut:            dialOut,
-		padding:            _padding,
 		idleSessionTimeout: idleSessionTimeout,
 		minIdleSession:     minIdleSession,
 	}
@@ -55,13 +94,91 @@ func NewClient(ctx context.Context, dialOut util.DialOutFunc,
 	if c.idleSessionTimeout <= time.Second*5 {
 		c.idleSessionTimeout = time.Second * 30
 	}
+	c.padding.Store(_padding.Load())
 	c.die, c.dieCancel = context.WithCancel(ctx)
 	c.idleSession = stl4go.NewSkipList[uint64, *Session]()
 	util.StartRoutine(c.die, idleSessionCheckInterval, c.idleCleanup)
 	return c
 }
 
+// SetHeartbeat enables active keepalive on sessions created afterwards
+func (c *Client) SetHeartbeat(config HeartbeatConfig) {
+	c.heartbeat = config
+}
+
+// SetMaxFrameSize sets the largest cmdPSH payload of sessions created afterwards
+func (c *Client) SetMaxFrameSize(size int) {
+	c.maxFrameSize = size
+}
+
+// ExpectServerPadding makes sessions created afterwards warn when the server pads with another scheme
+func (c *Client) ExpectServerPadding(md5 string) {
+	c.expectServerPadding = md5
+}
+
+// Padding returns the scheme sessions created now pad with
+func (c *Client) Padding() *padding.PaddingFactory {
+	return c.padding.Load()
+}
+
+// SetPaddingFile persists the padding scheme learned from the server at path.
+// A valid scheme already saved there replaces the current one, so that it survives restarts.
+func (c *Client) SetPaddingFile(path string) error {
+	c.paddingFile = path
+	rawScheme, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	p := padding.NewPaddingFactory(rawScheme)
+	if p == nil {
+		return fmt.Errorf("wrong format padding scheme file: %s", path)
+	}
+	c.padding.Store(p)
+	return nil
+}
+
+// savePadding writes a scheme pushed by the server to the padding file, if any
+func (c *Client) savePadding(p *padding.PaddingFactory) {
+	if c.paddingFile == "" {
+		return
+	}
+	c.paddingFileLock.Lock()
+	defer c.paddingFileLock.Unlock()
+	tmp := c.paddingFile + ".tmp"
+	err := os.WriteFile(tmp, p.RawScheme, 0o644)
+	if err == nil {
+		err = os.Rename(tmp, c.paddingFile)
+	}
+	if err != nil {
+		logrus.Warnln("[Save padding failed]", err)
+	}
+}
+
+// SetRotationPolicy sets when sessions created afterwards are retired
+func (c *Client) SetRotationPolicy(policy RotationPolicy) {
+	c.rotation = policy
+}
+
+// SetIdlePolicy sets how idle sessions are validated before reuse
+func (c *Client) SetIdlePolicy(policy IdlePolicy) {
+	c.idlePolicy = policy
+}
+
+// CreateStream opens a stream on an idle session, or on a new one if none is fit for reuse.
+// The returned *ClientStream is moved to a new session if its session dies before the server sent anything.
 func (c *Client) CreateStream(ctx context.Context) (net.Conn, error) {
+	stream, err := c.openStream(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	return newClientStream(c, stream), nil
+}
+
+// openStream opens a stream, on an idle session if reuse is true
+func (c *Client) openStream(ctx context.Context, reuse bool) (*Stream, error) {
 	select {
 	case <-c.die.Done():
 		return nil, io.ErrClosedPipe
@@ -72,29 +189,57 @@ func (c *Client) CreateStream(ctx context.Context) (net.Conn, error) {
 	var stream *Stream
 	var err error
 
-	session = c.getIdleSession()
-	if session == nil {
-		session, err = c.createSession(ctx)
-		if session != nil && clientDebugSessionPool {
-			logrus.Infoln("create session:", session.seq)
+	for reuse {
+		session = c.getIdleSession()
+		if session == nil {
+			break
 		}
-	} else {
 		if clientDebugSessionPool {
 			logrus.Infoln("get session:", session.seq)
 		}
+		if c.checkIdleSession(ctx, session) {
+			stream, err = session.OpenStream()
+			if err == nil {
+				break
+			}
+			if errors.Is(err, ErrGoAway) {
+				// it closes itself once drained
+				continue
+			}
+		}
+		// stale session, the caller should not notice it
+		if clientDebugSessionPool {
+			logrus.Infoln("discard stale session:", session.seq)
+		}
+		session.Close()
 	}
 	if session == nil {
-		return nil, fmt.Errorf("failed to create session: %w", err)
+		session, err = c.createSession(ctx)
+		if session == nil {
+			return nil, fmt.Errorf("failed to create session: %w", err)
+		}
+		if clientDebugSessionPool {
+			logrus.Infoln("create session:", session.seq)
+		}
+		stream, err = session.OpenStream()
+		if err != nil {
+			session.Close()
+			return nil, fmt.Errorf("failed to create stream: %w", err)
+		}
 	}
-	stream, err = session.OpenStream()
-	if err != nil {
-		session.Close()
-		return nil, fmt.Errorf("failed to create stream: %w", err)
+
+	if c.rotation.MaxStreams > 0 && stream.id >= c.rotation.MaxStreams {
+		c.retireSession(session, "streams")
 	}
 
 	stream.dieHook = func() {
+		if c.rotation.MaxBytes > 0 {
+			if sent, received := session.Traffic(); sent+received >= c.rotation.MaxBytes {
+				c.retireSession(session, "bytes")
+			}
+		}
 		// If Session is not closed, put this Stream to pool
-		if !session.IsClosed() {
+		if !session.IsClosed() && !session.IsDraining() {
 			if clientDebugSessionPool {
 				logrus.Infoln("put session:", session.seq, stream.id)
 			}
@@ -105,6 +250,7 @@ func (c *Client) CreateStream(ctx context.Context) (net.Conn, error) {
 			default:
 				c.idleSessionLock.Lock()
 				session.idleSince = time.Now()
+				session.idleStart = session.idleSince
 				c.idleSession.Insert(math.MaxUint64-session.seq, session)
 				c.idleSessionLock.Unlock()
 			}
@@ -129,17 +275,61 @@ func (c *Client) getIdleSession() (idle *Session) {
 	return
 }
 
+// retireSession stops reusing a session that hit a RotationPolicy limit
+func (c *Client) retireSession(session *Session, reason string) {
+	if clientDebugSessionPool {
+		logrus.Infoln("retire session:", session.seq, reason)
+	}
+	session.drain()
+}
+
+// checkIdleSession applies the IdlePolicy to a session taken from the pool
+func (c *Client) checkIdleSession(ctx context.Context, session *Session) bool {
+	if session.IsClosed() {
+		return false
+	}
+	if c.idlePolicy.MaxIdleAge > 0 && time.Since(session.idleStart) > c.idlePolicy.MaxIdleAge {
+		return false
+	}
+	if c.idlePolicy.ProbeAfter > 0 && time.Since(time.Unix(0, session.lastRecv.Load())) > c.idlePolicy.ProbeAfter {
+		timeout := c.idlePolicy.ProbeTimeout
+		if timeout <= 0 {
+			timeout = max(time.Second, session.RTT()*4)
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		rtt, err := session.Ping(ctx)
+		if clientDebugSessionPool {
+			logrus.Infoln("probe session:", session.seq, rtt, err)
+		}
+		return err == nil
+	}
+	return true
+}
+
 func (c *Client) createSession(ctx context.Context) (*Session, error) {
 	underlying, err := c.dialOut(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	session := NewClientSession(underlying, &padding.DefaultPaddingFactory)
+	session := NewClientSession(underlying, &c.padding)
 	session.seq = c.sessionCounter.Add(1)
+	session.SetHeartbeat(c.heartbeat)
+	session.SetMaxFrameSize(c.maxFrameSize)
+	session.ExpectServerPadding(c.expectServerPadding)
+	session.onPaddingUpdate = c.savePadding
+	session.onDrain = func() {
+		if clientDebugSessionPool {
+			logrus.Infoln("session draining:", session.seq)
+		}
+		c.idleSessionLock.Lock()
+		c.idleSession.Remove(math.MaxUint64 - session.seq)
+		c.idleSessionLock.Unlock()
+	}
 	session.dieHook = func() {
 		if clientDebugSessionPool {
-			logrus.Infoln("session died:", session.seq, session.streamId.Load(), session.pktCounter.Load())
+			logrus.Infoln("session died:", session.seq, session.streamId.Load(), session.pktCounter.Load(), session.RTT())
 		}
 
 		c.idleSessionLock.Lock()
@@ -155,6 +345,19 @@ func (c *Client) createSession(ctx context.Context) (*Session, error) {
 	c.sessions[session.seq] = session
 	c.sessionsLock.Unlock()
 
+	if lifetime := c.rotation.MaxLifetime; lifetime > 0 {
+		if c.rotation.LifetimeJitter > 0 {
+			lifetime += rand.N(c.rotation.LifetimeJitter)
+		}
+		retire := time.AfterFunc(lifetime, func() {
+			c.retireSession(session, "lifetime")
+		})
+		go func() {
+			<-session.die
+			retire.Stop()
+		}()
+	}
+
 	session.Run()
 	return session, nil
 }
@@ -0,0 +1,288 @@
+package session
+
+import (
+	"anytls/proxy/padding"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+)
+
+// testServers dials client sessions to server sessions over net.Pipe
+type testServers struct {
+	lock        sync.Mutex
+	sessions    []*Session
+	onNewStream func(*Stream)
+	// padding is the scheme of the servers, nil for the default one
+	padding *atomic.TypedValue[*padding.PaddingFactory]
+}
+
+func (s *testServers) dial(ctx context.Context) (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	p := s.padding
+	if p == nil {
+		p = &padding.DefaultPaddingFactory
+	}
+	srv := NewServerSession(c2, s.onNewStream, p)
+	s.lock.Lock()
+	s.sessions = append(s.sessions, srv)
+	s.lock.Unlock()
+	go srv.Run()
+	return c1, nil
+}
+
+func (s *testServers) dialed() []*Session {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*Session(nil), s.sessions...)
+}
+
+// newTestClient returns a Client dialing servers, it is closed with the test
+func newTestClient(t *testing.T, servers *testServers) *Client {
+	c := NewClient(context.Background(), servers.dial, &padding.DefaultPaddingFactory, time.Minute, time.Minute, 0)
+	t.Cleanup(func() {
+		c.Close()
+		for _, srv := range servers.dialed() {
+			srv.Close()
+		}
+	})
+	return c
+}
+
+func TestClientGoAway(t *testing.T) {
+	servers := &testServers{onNewStream: func(s *Stream) {
+		s.HandshakeSuccess()
+		echo(s)
+	}}
+	c := newTestClient(t, servers)
+	old, err := c.CreateStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, old, []byte("hello"))
+	servers.dialed()[0].GoAway("shutdown")
+	deadline := time.Now().Add(5 * time.Second)
+	for !old.(*ClientStream).current().sess.IsDraining() {
+		if time.Now().After(deadline) {
+			t.Fatal("client not draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// new streams go to a new session, the old one keeps serving its stream
+	stream, err := c.CreateStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	roundTrip(t, stream, []byte("new"))
+	if n := len(servers.dialed()); n != 2 {
+		t.Fatal("dialed", n, "sessions")
+	}
+	roundTrip(t, old, []byte("old"))
+	old.Close()
+	select {
+	case <-servers.dialed()[0].die:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drained session not closed")
+	}
+}
+
+func TestClientStreamRetry(t *testing.T) {
+	servers := &testServers{onNewStream: func(s *Stream) {
+		s.HandshakeSuccess()
+		b := make([]byte, 5)
+		if _, err := io.ReadFull(s, b); err != nil {
+			return
+		}
+		switch string(b) {
+		case "stale":
+			// the connection dies after the request reached the server
+			s.sess.Close()
+		case "fin  ":
+			s.Close()
+		case "part ":
+			s.Write([]byte("partial"))
+			time.Sleep(50 * time.Millisecond)
+			s.sess.Close()
+		default:
+			s.Write(b)
+			echo(s)
+		}
+	}}
+	c := newTestClient(t, servers)
+	open := func() net.Conn {
+		t.Helper()
+		stream, err := c.CreateStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.SetDeadline(time.Now().Add(5 * time.Second))
+		return stream
+	}
+
+	// a session dying before anything was written is replaced transparently
+	stream := open()
+	servers.dialed()[0].Close()
+	for !stream.(*ClientStream).current().sess.IsClosed() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 10)
+	if _, err := io.ReadFull(stream, b[:5]); err != nil || string(b[:5]) != "hello" {
+		t.Fatal(string(b[:5]), err)
+	}
+	stream.Close()
+	if n := len(servers.dialed()); n != 2 {
+		t.Fatal("dialed", n, "sessions")
+	}
+
+	// written data is never sent twice, the caller sees the failure instead
+	stream = open()
+	stream.Write([]byte("stale"))
+	if n, err := stream.Read(b); n != 0 || err == nil {
+		t.Fatal("read", n, err)
+	}
+	stream.Close()
+	if n := len(servers.dialed()); n != 2 {
+		t.Fatal("dialed", n, "sessions")
+	}
+
+	// a stream the server closed on a live session is not retried
+	stream = open()
+	stream.Write([]byte("fin  "))
+	if n, err := stream.Read(b); n != 0 || err == nil {
+		t.Fatal("read", n, err)
+	}
+	stream.Close()
+
+	// once the caller got data, it sees the failure
+	stream = open()
+	stream.Write([]byte("part "))
+	if n, err := stream.Read(b); err != nil || string(b[:n]) != "partial" {
+		t.Fatal("read", string(b[:n]), err)
+	}
+	if _, err := stream.Read(b); err == nil {
+		t.Fatal("failure after data was hidden")
+	}
+	stream.Close()
+	if n := len(servers.dialed()); n != 3 {
+		t.Fatal("dialed", n, "sessions")
+	}
+}
+
+func TestClientPadding(t *testing.T) {
+	pushed := new(atomic.TypedValue[*padding.PaddingFactory])
+	pushed.Store(padding.NewPaddingFactory([]byte("stop=2\n0=30-30\n1=100-400")))
+	servers := &testServers{onNewStream: echo, padding: pushed}
+	c := newTestClient(t, servers)
+	defaultMd5 := padding.DefaultPaddingFactory.Load().Md5
+
+	stream, err := c.CreateStream(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, stream, []byte("hello"))
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Padding().Md5 != pushed.Load().Md5 {
+		if time.Now().After(deadline) {
+			t.Fatal("pushed scheme not learned")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the value given to NewClient is only copied
+	if md5 := padding.DefaultPaddingFactory.Load().Md5; md5 != defaultMd5 {
+		t.Fatal("pushed scheme stored into the default padding", md5)
+	}
+}
+
+// waitClosed waits until the session is closed
+func waitClosed(t *testing.T, s *Session) {
+	t.Helper()
+	select {
+	case <-s.die:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed")
+	}
+}
+
+func TestClientRotation(t *testing.T) {
+	// use opens a stream, exchanges n bytes each way and closes the stream, returning its client session
+	use := func(t *testing.T, c *Client, n int) *Session {
+		t.Helper()
+		stream, err := c.CreateStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, stream, make([]byte, n))
+		sess := stream.(*ClientStream).current().sess
+		stream.Close()
+		return sess
+	}
+
+	t.Run("streams", func(t *testing.T) {
+		servers := &testServers{onNewStream: echo}
+		c := newTestClient(t, servers)
+		c.SetRotationPolicy(RotationPolicy{MaxStreams: 2})
+		first := use(t, c, 10)
+		if use(t, c, 10) != first {
+			t.Fatal("session not reused below the limit")
+		}
+		if use(t, c, 10) == first {
+			t.Fatal("session reused after MaxStreams")
+		}
+		waitClosed(t, first)
+		if n := len(servers.dialed()); n != 2 {
+			t.Fatal("dialed", n, "sessions")
+		}
+	})
+
+	t.Run("bytes", func(t *testing.T) {
+		servers := &testServers{onNewStream: echo}
+		c := newTestClient(t, servers)
+		c.SetRotationPolicy(RotationPolicy{MaxBytes: 1000})
+		first := use(t, c, 400)
+		if use(t, c, 10) != first {
+			t.Fatal("session not reused below the limit")
+		}
+		// sent and received count together
+		use(t, c, 100)
+		if use(t, c, 10) == first {
+			t.Fatal("session reused after MaxBytes")
+		}
+		waitClosed(t, first)
+	})
+
+	t.Run("lifetime", func(t *testing.T) {
+		const lifetime = 200 * time.Millisecond
+		servers := &testServers{onNewStream: echo}
+		c := newTestClient(t, servers)
+		c.SetRotationPolicy(RotationPolicy{MaxLifetime: lifetime})
+		first := use(t, c, 10)
+		if use(t, c, 10) != first {
+			t.Fatal("session not reused within its lifetime")
+		}
+		open, err := c.CreateStream(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * lifetime)
+
+		// the retired session takes no new streams but keeps serving the open one
+		if use(t, c, 10) == first {
+			t.Fatal("session reused after MaxLifetime")
+		}
+		if open.(*ClientStream).current().sess != first || !first.IsDraining() {
+			t.Fatal("open stream moved or session not draining")
+		}
+		roundTrip(t, open, []byte("still open"))
+		open.Close()
+		waitClosed(t, first)
+	})
+}
@@ -0,0 +1,175 @@
+package session
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ClientStream is the stream returned by Client.CreateStream.
+// If its session dies before the caller wrote anything (a stale pooled session, a middlebox dropping the connection),
+// the stream is opened again on a new session and the caller does not notice.
+// Nothing written is ever sent twice: once the caller wrote data, read data, or took the stream by Stream,
+// it behaves like the Stream it wraps.
+type ClientStream struct {
+	client *Client
+
+	lock    sync.Mutex
+	stream  *Stream
+	movable bool // nothing can have reached the target yet, the stream may still be moved
+	closed  bool
+
+	priority      int
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newClientStream(client *Client, stream *Stream) *ClientStream {
+	return &ClientStream{
+		client:  client,
+		stream:  stream,
+		movable: true,
+	}
+}
+
+// current returns the stream in use
+func (s *ClientStream) current() *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.stream
+}
+
+// Stream returns the stream in use, it is not moved to another session anymore
+func (s *ClientStream) Stream() *Stream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.movable = false
+	return s.stream
+}
+
+// Read implements net.Conn
+func (s *ClientStream) Read(b []byte) (int, error) {
+	for {
+		stream := s.current()
+		n, err := stream.Read(b)
+		if n > 0 {
+			// the server answered, from now on the caller would notice a move
+			s.Stream()
+			return n, err
+		}
+		if err == nil || !s.retry(stream) {
+			return n, err
+		}
+	}
+}
+
+// Write implements net.Conn
+func (s *ClientStream) Write(b []byte) (int, error) {
+	for {
+		stream := s.current()
+		n, err := stream.Write(b)
+		if n > 0 || err == nil {
+			// the data may reach the target, it must not be sent again
+			s.Stream()
+			return n, err
+		}
+		if !s.retry(stream) {
+			return n, err
+		}
+	}
+}
+
+// retry opens the stream again on a new session if failed died with its session before anything was written or read.
+// It reports whether the caller should go on with the new stream.
+func (s *ClientStream) retry(failed *Stream) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stream != failed {
+		// moved by a concurrent Read or Write
+		return true
+	}
+	// a stream closed or reset by the server on a live session failed for real
+	if !s.movable || s.closed || !failed.sess.IsClosed() {
+		return false
+	}
+	// a single attempt, if the new session fails as well the caller sees it
+	s.movable = false
+	stream, err := s.client.openStream(s.client.die, false)
+	if err != nil {
+		logrus.Debugln("reopen stream:", err)
+		return false
+	}
+	if s.priority > 0 {
+		stream.SetPriority(s.priority)
+	}
+	stream.SetReadDeadline(s.readDeadline)
+	stream.SetWriteDeadline(s.writeDeadline)
+	if clientDebugSessionPool {
+		logrus.Infoln("reopen stream:", failed.sess.seq, "->", stream.sess.seq)
+	}
+	s.stream = stream
+	return true
+}
+
+// Close implements net.Conn
+func (s *ClientStream) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	stream := s.stream
+	s.lock.Unlock()
+	return stream.Close()
+}
+
+// CloseWrite sends EOF to the server, see Stream.CloseWrite
+func (s *ClientStream) CloseWrite() error {
+	return s.Stream().CloseWrite()
+}
+
+// Reset aborts the stream, see Stream.Reset
+func (s *ClientStream) Reset(code uint32) error {
+	return s.Stream().Reset(code)
+}
+
+func (s *ClientStream) closeError() error {
+	return s.current().closeError()
+}
+
+// SetPriority sets the share of the session the stream gets, see Stream.SetPriority
+func (s *ClientStream) SetPriority(priority int) {
+	s.lock.Lock()
+	s.priority = priority
+	stream := s.stream
+	s.lock.Unlock()
+	stream.SetPriority(priority)
+}
+
+func (s *ClientStream) SetReadDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.readDeadline = t
+	stream := s.stream
+	s.lock.Unlock()
+	return stream.SetReadDeadline(t)
+}
+
+func (s *ClientStream) SetWriteDeadline(t time.Time) error {
+	s.lock.Lock()
+	s.writeDeadline = t
+	stream := s.stream
+	s.lock.Unlock()
+	return stream.SetWriteDeadline(t)
+}
+
+func (s *ClientStream) SetDeadline(t time.Time) error {
+	s.SetWriteDeadline(t)
+	return s.SetReadDeadline(t)
+}
+
+func (s *ClientStream) LocalAddr() net.Addr {
+	return s.current().LocalAddr()
+}
+
+func (s *ClientStream) RemoteAddr() net.Addr {
+	return s.current().RemoteAddr()
+}
@@ -0,0 +1,207 @@
+package session
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// DatagramDestination is the destination a stream is opened to when it carries a datagram flow instead of data.
+// The flow ID of its cmdDatagram frames is the stream ID.
+var DatagramDestination = M.Socksaddr{Fqdn: "sp.datagram.anytls.arpa"}
+
+var ErrDatagramUnsupported = errors.New("peer does not support datagrams")
+
+const (
+	// datagramQueueSize is how many received datagrams a flow keeps before dropping new ones
+	datagramQueueSize = 256
+	// maxQueuedDatagramBytes is how much a flow may have waiting for the connection before datagrams are dropped
+	maxQueuedDatagramBytes = 256 * 1024
+	// settingsTimeout bounds how long a client waits to learn what the server negotiated, see waitSettings
+	settingsTimeout = 3 * time.Second
+)
+
+// PacketConn sends and receives the datagrams of a flow, it implements N.PacketConn.
+// Datagrams keep their boundaries and may be dropped when the connection cannot keep up.
+type PacketConn struct {
+	stream *Stream
+}
+
+// OpenPacketConn turns a stream just opened by the client into a datagram flow.
+// It returns ErrDatagramUnsupported if the server did not negotiate FeatureDatagram,
+// in which case the stream is left untouched and may still be used otherwise.
+func OpenPacketConn(ctx context.Context, stream *Stream) (*PacketConn, error) {
+	if !stream.sess.waitSettings(ctx, settingsTimeout).Has(FeatureDatagram) {
+		return nil, ErrDatagramUnsupported
+	}
+	if err := M.SocksaddrSerializer.WriteAddrPort(stream, DatagramDestination); err != nil {
+		return nil, err
+	}
+	return &PacketConn{stream: stream}, nil
+}
+
+// AcceptPacketConn serves a flow the server read DatagramDestination from
+func AcceptPacketConn(stream *Stream) (*PacketConn, error) {
+	if !stream.sess.Features().Has(FeatureDatagram) {
+		return nil, ErrDatagramUnsupported
+	}
+	return &PacketConn{stream: stream}, nil
+}
+
+// ReadPacket returns the next datagram and the address carried with it:
+// the destination on the server, the source on the client.
+func (c *PacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	s := c.stream
+	select {
+	case datagram := <-s.datagramQueue():
+		defer datagram.Release()
+		s.waitRate(s.sess.receiveLimiters, datagram.Len(), s.die, s.readDeadline.Wait())
+		addr, err := M.SocksaddrSerializer.ReadAddrPort(datagram)
+		if err != nil {
+			return M.Socksaddr{}, err
+		}
+		_, err = buffer.ReadOnceFrom(datagram)
+		if err == io.EOF {
+			err = nil
+		}
+		return addr, err
+	case <-s.die:
+		return M.Socksaddr{}, s.dieErr
+	case <-s.readDeadline.Wait():
+		return M.Socksaddr{}, os.ErrDeadlineExceeded
+	}
+}
+
+// WritePacket sends a datagram, it does not wait for the connection, only for the rate limit if any.
+// Datagrams that do not fit in a frame of the negotiated size or find the flow congested are dropped without error.
+// Like ReadPacket, the rate limit and the traffic counters see the address as well as the payload.
+func (c *PacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	defer buffer.Release()
+	s := c.stream
+	select {
+	case <-s.die:
+		return s.dieErr
+	case <-s.writeDeadline.Wait():
+		return os.ErrDeadlineExceeded
+	default:
+	}
+	if s.writeClosed.Load() {
+		return io.ErrClosedPipe
+	}
+
+	dataLen := M.SocksaddrSerializer.AddrPortLen(destination) + buffer.Len()
+	if dataLen > s.sess.framePayloadSize() {
+		s.sess.datagramsDropped.Add(1)
+		return nil
+	}
+	// unlike congestion, the rate limit holds the writer back
+	if err := s.waitRate(s.sess.sendLimiters, dataLen, s.die, s.writeDeadline.Wait()); err != nil {
+		return err
+	}
+	frame := buf.NewSize(headerOverHeadSize + dataLen)
+	frame.WriteByte(cmdDatagram)
+	binary.BigEndian.PutUint32(frame.Extend(4), s.id)
+	binary.BigEndian.PutUint16(frame.Extend(2), uint16(dataLen))
+	if err := M.SocksaddrSerializer.WriteAddrPort(frame, destination); err != nil {
+		frame.Release()
+		return err
+	}
+	frame.Write(buffer.Bytes())
+	if !s.sess.scheduler.pushDatagram(&writeRequest{
+		buffer:   frame,
+		sid:      s.id,
+		priority: int(s.priority.Load()),
+	}) {
+		frame.Release()
+		s.sess.datagramsDropped.Add(1)
+		return nil
+	}
+	s.countSent(dataLen)
+	return nil
+}
+
+// Stream returns the stream the flow belongs to
+func (c *PacketConn) Stream() *Stream {
+	return c.stream
+}
+
+// Close ends the flow by closing its stream
+func (c *PacketConn) Close() error {
+	return c.stream.Close()
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.stream.LocalAddr()
+}
+
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
+
+// datagramQueue returns the queue of received datagrams, created on first use
+func (s *Stream) datagramQueue() chan *buf.Buffer {
+	s.datagramOnce.Do(func() {
+		s.datagrams = make(chan *buf.Buffer, datagramQueueSize)
+	})
+	return s.datagrams
+}
+
+// pushDatagram queues a received datagram, it never blocks recvLoop: if the flow is not read fast enough the datagram is dropped
+func (s *Stream) pushDatagram(datagram *buf.Buffer) {
+	select {
+	case s.datagramQueue() <- datagram:
+	default:
+		datagram.Release()
+		s.sess.datagramsDropped.Add(1)
+	}
+}
+
+// DatagramsDropped returns how many datagrams were dropped in either direction because of congestion or size
+func (s *Session) DatagramsDropped() uint64 {
+	return s.datagramsDropped.Load()
+}
+
+// waitSettings waits until the client knows what the server negotiated, and returns it.
+// The settings still buffered with the first cmdSYN are flushed, the server would not answer them otherwise.
+// A server that does not answer within timeout is taken to have no cmdServerSettings,
+// so that later flows on the session do not wait again.
+func (s *Session) waitSettings(ctx context.Context, timeout time.Duration) Features {
+	select {
+	case <-s.settingsDone:
+		return s.Features()
+	default:
+	}
+	s.connLock.Lock()
+	pending := len(s.buffer) > 0
+	s.connLock.Unlock()
+	if pending {
+		if err := s.writeFrame(&writeRequest{buffer: buf.New(), control: true}); err != nil {
+			return s.Features()
+		}
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-s.settingsDone:
+	case <-timer.C:
+		s.settingsKnown()
+	case <-ctx.Done():
+	case <-s.die:
+	}
+	return s.Features()
+}
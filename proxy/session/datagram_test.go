@@ -0,0 +1,198 @@
+package session
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// serveDatagrams is an onNewStream that echoes the datagrams of a flow, once release is closed
+func serveDatagrams(t *testing.T, release chan struct{}) func(*Stream) {
+	return func(s *Stream) {
+		defer s.Close()
+		destination, err := M.SocksaddrSerializer.ReadAddrPort(s)
+		if err != nil {
+			return
+		}
+		if destination != DatagramDestination {
+			// an ordinary stream
+			s.Write([]byte("ok"))
+			return
+		}
+		pc, err := AcceptPacketConn(s)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		<-release
+		for {
+			b := buf.NewSize(maxFrameSize)
+			addr, err := pc.ReadPacket(b)
+			if err != nil {
+				b.Release()
+				return
+			}
+			pc.WritePacket(b, addr)
+		}
+	}
+}
+
+func newPacket(size int, fill byte) *buf.Buffer {
+	b := buf.NewSize(size)
+	for range size {
+		b.WriteByte(fill)
+	}
+	return b
+}
+
+func TestDatagram(t *testing.T) {
+	for _, sizes := range [][2]int{
+		{0, 0},
+		{maxFrameSize, 4096},
+		{maxFrameSize, maxFrameSize},
+	} {
+		t.Run(strconv.Itoa(sizes[0])+"-"+strconv.Itoa(sizes[1]), func(t *testing.T) {
+			release := make(chan struct{})
+			close(release)
+			cli, srv := pairSessions(t, serveDatagrams(t, release), sizes[0], sizes[1])
+			stream, _ := cli.OpenStream()
+			pc, err := OpenPacketConn(context.Background(), stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+
+			destination := M.ParseSocksaddr("1.2.3.4:53")
+			addrLen := M.SocksaddrSerializer.AddrPortLen(destination)
+			// the largest datagram fits in a frame of the negotiated size with its address
+			largest := min(orDefault(sizes[0]), orDefault(sizes[1])) - addrLen
+			var total int
+			for i, size := range []int{1, 100, 1400, largest} {
+				if err := pc.WritePacket(newPacket(size, byte(i)), destination); err != nil {
+					t.Fatal(err)
+				}
+				pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+				b := buf.NewSize(maxFrameSize)
+				addr, err := pc.ReadPacket(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// boundaries and addresses are kept
+				if addr != destination || b.Len() != size || b.Byte(0) != byte(i) {
+					t.Fatal("got", addr, b.Len(), "want", destination, size)
+				}
+				b.Release()
+				total += addrLen + size
+			}
+
+			// too large for a frame, dropped without error
+			if err := pc.WritePacket(newPacket(largest+1, 0), destination); err != nil {
+				t.Fatal(err)
+			}
+			if cli.DatagramsDropped() != 1 || srv.DatagramsDropped() != 0 {
+				t.Fatal("dropped", cli.DatagramsDropped(), srv.DatagramsDropped())
+			}
+
+			// both directions count the address along with the payload, the stream also sent DatagramDestination
+			opening := M.SocksaddrSerializer.AddrPortLen(DatagramDestination)
+			if sent, received := stream.Traffic(); sent != uint64(opening+total) || received != uint64(total) {
+				t.Fatal("traffic", sent, received, "want", total)
+			}
+		})
+	}
+}
+
+func TestStalledFlow(t *testing.T) {
+	release := make(chan struct{})
+	cli, srv := pairSessions(t, serveDatagrams(t, release))
+	stream, _ := cli.OpenStream()
+	pc, err := OpenPacketConn(context.Background(), stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	destination := M.ParseSocksaddr("1.2.3.4:53")
+	for i := range 2 * datagramQueueSize {
+		pc.WritePacket(newPacket(1000, byte(i)), destination)
+	}
+
+	// the server does not read the flow, other streams must not notice
+	other, _ := cli.OpenStream()
+	M.SocksaddrSerializer.WriteAddrPort(other, destination)
+	other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := other.Read(make([]byte, 2)); err != nil {
+		t.Fatal("other stream blocked:", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for cli.DatagramsDropped()+srv.DatagramsDropped() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("nothing dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// what was kept is delivered once the flow is read again
+	close(release)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := buf.NewPacket()
+	defer b.Release()
+	if addr, err := pc.ReadPacket(b); err != nil || addr != destination || b.Len() != 1000 {
+		t.Fatal(addr, b.Len(), err)
+	}
+}
+
+func TestDatagramOldServer(t *testing.T) {
+	var payload []byte
+	done := make(chan struct{})
+	cli := pairOldServer(t, func(p *oldPeer, hdr rawHeader, data []byte) error {
+		switch hdr.Cmd() {
+		case cmdPSH:
+			payload = append(payload, data...)
+		case cmdFIN:
+			close(done)
+		}
+		return nil
+	}, 0)
+	stream, _ := cli.OpenStream()
+	start := time.Now()
+	if _, err := OpenPacketConn(context.Background(), stream); err != ErrDatagramUnsupported {
+		t.Fatal(err)
+	}
+	// a version 2 server answers the settings, there is no reason to wait for the timeout
+	if elapsed := time.Since(start); elapsed >= settingsTimeout {
+		t.Fatal("waited", elapsed)
+	}
+	// the stream is left for udp-over-tcp
+	stream.Write([]byte("uot"))
+	stream.Close()
+	<-done
+	if string(payload) != "uot" {
+		t.Fatal("server got", payload)
+	}
+}
+
+func TestDatagramSilentServer(t *testing.T) {
+	// a version 1 server sends nothing before the first data
+	cli := pairFakeServer(t, func(p *oldPeer, hdr rawHeader, data []byte) error { return nil }, 0)
+	first, _ := cli.OpenStream()
+	start := time.Now()
+	if _, err := OpenPacketConn(context.Background(), first); err != ErrDatagramUnsupported {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < settingsTimeout {
+		t.Fatal("gave up after", elapsed)
+	}
+	// the session remembers, later flows do not wait again
+	second, _ := cli.OpenStream()
+	start = time.Now()
+	if _, err := OpenPacketConn(context.Background(), second); err != ErrDatagramUnsupported {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("waited again for", elapsed)
+	}
+}
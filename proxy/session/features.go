@@ -0,0 +1,83 @@
+package session
+
+import (
+	"strings"
+)
+
+// protocolVersion is the `v` this implementation reports in settings
+const protocolVersion = 3
+
+// Feature is a protocol extension, it is only used when both sides support it
+type Feature uint32
+
+const (
+	FeatureSynAck      Feature = 1 << iota // cmdSYNACK, implied by version 2
+	FeatureHeartbeat                       // cmdHeartRequest / cmdHeartResponse, implied by version 2
+	FeatureFlowControl                     // cmdUpdateWindow
+	FeatureHalfClose                       // cmdCloseWrite
+	FeatureReset                           // cmdRST
+	FeatureGoAway                          // cmdGoAway
+	FeaturePaddingV2                       // cmdUpdatePaddingScheme may carry a version 2 scheme
+	FeatureDatagram                        // cmdDatagram
+)
+
+var featureNames = []struct {
+	feature Feature
+	name    string
+}{
+	{FeatureSynAck, "synack"},
+	{FeatureHeartbeat, "heartbeat"},
+	{FeatureFlowControl, "flow-control"},
+	{FeatureHalfClose, "half-close"},
+	{FeatureReset, "reset"},
+	{FeatureGoAway, "goaway"},
+	{FeaturePaddingV2, "padding-v2"},
+	{FeatureDatagram, "datagram"},
+}
+
+// version2Features are not listed in settings by version 2 peers
+const version2Features = FeatureSynAck | FeatureHeartbeat
+
+// supportedFeatures is what this implementation advertises
+const supportedFeatures = FeatureSynAck | FeatureHeartbeat | FeatureFlowControl | FeatureHalfClose | FeatureReset | FeatureGoAway | FeaturePaddingV2 | FeatureDatagram
+
+// Features is the set of extensions negotiated on a session
+type Features uint32
+
+// Has reports whether feature is enabled
+func (f Features) Has(feature Feature) bool {
+	return Feature(f)&feature != 0
+}
+
+// String returns the comma separated names carried by the `features` key of settings
+func (f Features) String() string {
+	var names []string
+	for _, n := range featureNames {
+		if f.Has(n.feature) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseFeatures reads the `features` key of settings, unknown names are ignored
+func ParseFeatures(s string) Features {
+	var f Features
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		for _, n := range featureNames {
+			if n.name == name {
+				f |= Features(n.feature)
+			}
+		}
+	}
+	return f
+}
+
+// negotiateFeatures intersects the features announced by the peer with ours
+func negotiateFeatures(peerVersion int, announced Features) Features {
+	if peerVersion >= 2 {
+		announced |= Features(version2Features)
+	}
+	return announced & Features(supportedFeatures)
+}
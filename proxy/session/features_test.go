@@ -0,0 +1,78 @@
+package session
+
+import (
+	"anytls/util"
+	"testing"
+)
+
+func TestParseFeatures(t *testing.T) {
+	all := Features(supportedFeatures)
+	if got := ParseFeatures(all.String()); got != all {
+		t.Fatal("round trip", got)
+	}
+	// unknown names and spaces are ignored, the order does not matter
+	got := ParseFeatures(" reset, future-feature ,synack,,")
+	if got != Features(FeatureReset|FeatureSynAck) || got.String() != "synack,reset" {
+		t.Fatal(got)
+	}
+	if ParseFeatures("") != 0 || Features(0).String() != "" {
+		t.Fatal("empty features")
+	}
+}
+
+func TestNegotiateFeatures(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		version   int
+		announced Features
+		want      Features
+	}{
+		{"version 1", 1, 0, 0},
+		{"version 1 announcing", 1, Features(FeatureReset), Features(FeatureReset)},
+		{"version 2 implies synack and heartbeat", 2, 0, Features(version2Features)},
+		{"version 3 intersection", 3, Features(FeatureFlowControl | FeatureGoAway), Features(version2Features | FeatureFlowControl | FeatureGoAway)},
+		{"everything", 3, Features(supportedFeatures), Features(supportedFeatures)},
+		{"unsupported bits", 3, Features(FeatureReset) | 1<<30, Features(version2Features | FeatureReset)},
+	} {
+		if got := negotiateFeatures(c.version, c.announced); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+// serverSettingsFor sends the settings of a client and returns what the server answers with
+func serverSettingsFor(t *testing.T, settings util.StringMap) (util.StringMap, *Session) {
+	t.Helper()
+	p, srv := pairOldClient(t, nil, 0)
+	go p.writeFrame(cmdSettings, 0, settings.ToBytes())
+	for {
+		hdr, data, err := p.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Cmd() == cmdServerSettings {
+			return util.StringMapFromBytes(data), srv
+		}
+	}
+}
+
+func TestServerNegotiation(t *testing.T) {
+	// a version 2 client lists no features, it still gets synack and heartbeat
+	m, srv := serverSettingsFor(t, util.StringMap{"v": "2"})
+	if m["features"] != "synack,heartbeat" || srv.Features() != Features(version2Features) {
+		t.Fatal("version 2:", m["features"], srv.Features())
+	}
+	if m["v"] != "3" {
+		t.Fatal("version", m["v"])
+	}
+
+	// flow control also needs the client's window
+	m, srv = serverSettingsFor(t, util.StringMap{"v": "3", "features": "flow-control,reset,future-feature"})
+	if want := Features(version2Features | FeatureReset); m["features"] != want.String() || srv.Features() != want {
+		t.Fatal("without a window:", m["features"], srv.Features())
+	}
+	m, srv = serverSettingsFor(t, util.StringMap{"v": "3", "features": "flow-control", "stream-window": "65536"})
+	if !srv.Features().Has(FeatureFlowControl) || m["stream-window"] == "" {
+		t.Fatal("with a window:", m["features"], m["stream-window"])
+	}
+}
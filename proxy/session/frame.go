@@ -17,10 +17,27 @@ const ( // cmds
 	cmdHeartRequest   = 8  // Keep alive command
 	cmdHeartResponse  = 9  // Keep alive command
 	cmdServerSettings = 10 // Settings (Server send to client)
+	// Extensions, only sent to peers that advertised them in settings
+	cmdUpdateWindow = 11 // Grant more receive window of a stream to the peer
+	cmdCloseWrite   = 12 // stream half close, the sender will not send cmdPSH anymore
+	cmdRST          = 13 // stream abort, carries an error code instead of an EOF mark
+	cmdGoAway       = 14 // Server tells the client not to open new streams on this session
+	cmdDatagram     = 15 // one datagram of the flow opened as stream sid, may be dropped
 )
 
 const (
 	headerOverHeadSize = 1 + 4 + 2
+	// maxFrameSize is the largest payload the uint16 length field can describe
+	maxFrameSize = 65535
+	// defaultMaxFrameSize makes a full cmdPSH fit into a single TLS record
+	defaultMaxFrameSize = 16384 - headerOverHeadSize
+	minFrameSize        = 1024
+)
+
+const (
+	// defaultStreamWindow is the per-stream receive window advertised to the peer,
+	// and the initial send window assumed before the peer has advertised its own.
+	defaultStreamWindow = 1024 * 1024
 )
 
 // frame defines a packet from or to be multiplexed into a single connection
@@ -0,0 +1,146 @@
+package session
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HeartbeatConfig controls active keepalive of a session
+type HeartbeatConfig struct {
+	// Interval is how long a session may receive nothing before a cmdHeartRequest is sent,
+	// and how long each request waits for its response. Zero disables active keepalive.
+	Interval time.Duration
+	// MaxMissed is the number of consecutive unanswered requests after which the session is closed.
+	MaxMissed int
+}
+
+type heartRequest struct {
+	sentAt time.Time
+	done   chan struct{}
+}
+
+// SetHeartbeat must be called before Run
+func (s *Session) SetHeartbeat(config HeartbeatConfig) {
+	if config.MaxMissed <= 0 {
+		config.MaxMissed = 3
+	}
+	s.heartbeat = config
+}
+
+// RTT returns the smoothed round trip time measured by heartbeats, or 0 if nothing was measured yet
+func (s *Session) RTT() time.Duration {
+	return time.Duration(s.rtt.Load())
+}
+
+// Ping sends a cmdHeartRequest and waits for its response, returning the measured round trip time.
+// Peers without FeatureHeartbeat cannot be probed, for them Ping returns immediately.
+func (s *Session) Ping(ctx context.Context) (time.Duration, error) {
+	if !s.Features().Has(FeatureHeartbeat) {
+		return 0, nil
+	}
+	seq, req, err := s.sendHeartRequest()
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case <-req.done:
+		return time.Since(req.sentAt), nil
+	case <-s.die:
+		return 0, io.ErrClosedPipe
+	case <-ctx.Done():
+		s.heartLock.Lock()
+		delete(s.heartInflight, seq)
+		s.heartLock.Unlock()
+		return 0, ctx.Err()
+	}
+}
+
+func (s *Session) sendHeartRequest() (uint32, *heartRequest, error) {
+	req := &heartRequest{
+		sentAt: time.Now(),
+		done:   make(chan struct{}),
+	}
+	s.heartLock.Lock()
+	s.heartSeq++
+	seq := s.heartSeq
+	if s.heartInflight == nil {
+		s.heartInflight = make(map[uint32]*heartRequest)
+	}
+	s.heartInflight[seq] = req
+	s.heartLock.Unlock()
+
+	if _, err := s.writeControlFrame(newFrame(cmdHeartRequest, seq)); err != nil {
+		return seq, nil, err
+	}
+	return seq, req, nil
+}
+
+func (s *Session) heartbeatLoop() {
+	ticker := time.NewTicker(s.heartbeat.Interval)
+	defer ticker.Stop()
+
+	var missed int
+	var lastSeq uint32
+	for {
+		select {
+		case <-s.die:
+			return
+		case <-ticker.C:
+		}
+		if !s.Features().Has(FeatureHeartbeat) {
+			continue
+		}
+		lastRecv := time.Unix(0, s.lastRecv.Load())
+		if time.Since(lastRecv) < s.heartbeat.Interval {
+			// the peer is alive, an unanswered request is not waited for anymore
+			missed = 0
+			s.heartLock.Lock()
+			delete(s.heartInflight, lastSeq)
+			s.heartLock.Unlock()
+			continue
+		}
+
+		s.heartLock.Lock()
+		if req, ok := s.heartInflight[lastSeq]; ok {
+			delete(s.heartInflight, lastSeq)
+			if lastRecv.After(req.sentAt) {
+				// anything received after the request counts as an answer
+				missed = 0
+			} else {
+				missed++
+			}
+		}
+		s.heartLock.Unlock()
+		if missed >= s.heartbeat.MaxMissed {
+			logrus.Debugln("session heartbeat timeout:", s.conn.RemoteAddr(), missed)
+			s.Close()
+			return
+		}
+
+		seq, _, err := s.sendHeartRequest()
+		if err != nil {
+			return
+		}
+		lastSeq = seq
+	}
+}
+
+// onHeartResponse takes an RTT sample and wakes up the waiter of the matching request
+func (s *Session) onHeartResponse(seq uint32) {
+	s.heartLock.Lock()
+	req, ok := s.heartInflight[seq]
+	delete(s.heartInflight, seq)
+	s.heartLock.Unlock()
+	if !ok {
+		return
+	}
+	sample := time.Since(req.sentAt)
+	if srtt := time.Duration(s.rtt.Load()); srtt > 0 {
+		sample = srtt - srtt/8 + sample/8
+	}
+	s.rtt.Store(int64(sample))
+	close(req.done)
+}
@@ -0,0 +1,99 @@
+package session
+
+import (
+	"anytls/proxy/padding"
+	"anytls/util"
+	"net"
+	"testing"
+	"time"
+)
+
+const testHeartbeatInterval = 50 * time.Millisecond
+
+// pairHeartbeatServer connects a client session with heartbeats to a version 2 server,
+// onHeartRequest decides how the server reacts to a cmdHeartRequest
+func pairHeartbeatServer(t *testing.T, onHeartRequest func(p *oldPeer, seq uint32) error) *Session {
+	c1, c2 := net.Pipe()
+	p := &oldPeer{conn: c2}
+	go func() {
+		defer c2.Close()
+		for {
+			hdr, _, err := p.readFrame()
+			if err != nil {
+				return
+			}
+			switch hdr.Cmd() {
+			case cmdSettings:
+				err = p.writeFrame(cmdServerSettings, 0, util.StringMap{"v": "2"}.ToBytes())
+			case cmdSYN:
+				err = p.writeFrame(cmdSYNACK, hdr.StreamID(), nil)
+			case cmdHeartRequest:
+				err = onHeartRequest(p, hdr.StreamID())
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	cli := NewClientSession(c1, &padding.DefaultPaddingFactory)
+	cli.SetHeartbeat(HeartbeatConfig{Interval: testHeartbeatInterval, MaxMissed: 3})
+	cli.Run()
+	t.Cleanup(func() { cli.Close() })
+	// the client's settings go out with its first stream
+	stream, err := cli.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Write([]byte{1})
+	waitSettingsKnown(t, cli)
+	return cli
+}
+
+func heartInflight(s *Session) int {
+	s.heartLock.Lock()
+	defer s.heartLock.Unlock()
+	return len(s.heartInflight)
+}
+
+func TestHeartbeat(t *testing.T) {
+	t.Run("answered", func(t *testing.T) {
+		cli := pairHeartbeatServer(t, func(p *oldPeer, seq uint32) error {
+			return p.writeFrame(cmdHeartResponse, seq, nil)
+		})
+		deadline := time.Now().Add(5 * time.Second)
+		for cli.RTT() == 0 {
+			if time.Now().After(deadline) || cli.IsClosed() {
+				t.Fatal("no round trip measured, closed:", cli.IsClosed())
+			}
+			time.Sleep(testHeartbeatInterval)
+		}
+	})
+
+	t.Run("silent", func(t *testing.T) {
+		cli := pairHeartbeatServer(t, func(p *oldPeer, seq uint32) error { return nil })
+		select {
+		case <-cli.die:
+		case <-time.After(5 * time.Second):
+			t.Fatal("session not closed after unanswered heartbeats")
+		}
+	})
+
+	t.Run("data", func(t *testing.T) {
+		// the server never answers, but anything it sends shows it is alive
+		cli := pairHeartbeatServer(t, func(p *oldPeer, seq uint32) error {
+			return p.writeFrame(cmdWaste, 0, nil)
+		})
+		for i := 0; i < 20; i++ {
+			time.Sleep(testHeartbeatInterval)
+			if cli.IsClosed() {
+				t.Fatal("session closed although the server sent data")
+			}
+			if n := heartInflight(cli); n > 1 {
+				t.Fatal(n, "heartbeats in flight")
+			}
+		}
+		if cli.RTT() != 0 {
+			t.Fatal("round trip measured without a response")
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package session
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// minRateBurst lets a limited stream still send a full frame at once
+const minRateBurst = 65535
+
+// RateLimiter is a token bucket of payload bytes per second. One limiter may be shared by
+// any number of sessions, e.g. all sessions of a user or the whole server.
+// Streams wait for tokens instead of dropping data, which holds back the flow control
+// window (or recvLoop for peers without flow control) and so slows down the peer too.
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64 // bytes per second, 0 is unlimited
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSecond on average and bursts of up to burst bytes.
+// A burst <= 0 defaults to one second worth of bytes, a rate <= 0 does not limit at all.
+func NewRateLimiter(bytesPerSecond, burst int64) *RateLimiter {
+	l := new(RateLimiter)
+	l.SetLimit(bytesPerSecond, burst)
+	return l
+}
+
+// SetLimit changes the rate, sessions using the limiter follow immediately
+func (l *RateLimiter) SetLimit(bytesPerSecond, burst int64) {
+	if burst <= 0 {
+		burst = bytesPerSecond
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.rate = float64(max(bytesPerSecond, 0))
+	l.burst = float64(max(burst, minRateBurst))
+	l.tokens = min(l.tokens, l.burst)
+	if l.last.IsZero() {
+		l.tokens = l.burst
+	}
+	l.last = time.Now()
+}
+
+// Limit returns the rate in bytes per second, 0 is unlimited
+func (l *RateLimiter) Limit() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return int64(l.rate)
+}
+
+// reserve takes n tokens, possibly going into debt, and returns how long to wait until they are covered
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// refund returns tokens of a reservation that was given up
+func (l *RateLimiter) refund(n int) {
+	l.lock.Lock()
+	l.tokens = min(l.burst, l.tokens+float64(n))
+	l.lock.Unlock()
+}
+
+// AddRateLimiter makes the streams of the session wait for tokens of send before sending payload,
+// and for tokens of receive before handing received payload to the reader. Either may be nil.
+// Several limiters may be added, e.g. per session, per user and global, the slowest one wins.
+// It must be called before Run.
+func (s *Session) AddRateLimiter(send, receive *RateLimiter) {
+	if send != nil {
+		s.sendLimiters = append(s.sendLimiters, send)
+	}
+	if receive != nil {
+		s.receiveLimiters = append(s.receiveLimiters, receive)
+	}
+}
+
+// waitRate blocks until n bytes are allowed by every limiter.
+// If die is closed, the session dies or the deadline passes first, the tokens are given back.
+func (s *Stream) waitRate(limiters []*RateLimiter, n int, die, deadline <-chan struct{}) error {
+	if len(limiters) == 0 || n == 0 {
+		return nil
+	}
+	var wait time.Duration
+	for _, l := range limiters {
+		wait = max(wait, l.reserve(n))
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-timer.C:
+		return nil
+	case <-die:
+		err = s.dieErr
+	case <-s.sess.die:
+		err = io.ErrClosedPipe
+	case <-deadline:
+		err = os.ErrDeadlineExceeded
+	}
+	for _, l := range limiters {
+		l.refund(n)
+	}
+	return err
+}
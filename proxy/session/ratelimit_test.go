@@ -0,0 +1,166 @@
+package session
+
+import (
+	"anytls/proxy/padding"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testRate  = 1 << 20
+	testBurst = minRateBurst
+)
+
+func tokens(l *RateLimiter) float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.tokens
+}
+
+// pairLimitedSessions is pairSessions with limiters added before the sessions run
+func pairLimitedSessions(t *testing.T, onNewStream func(*Stream), limit func(cli, srv *Session)) (cli, srv *Session) {
+	c1, c2 := net.Pipe()
+	srv = NewServerSession(c2, onNewStream, &padding.DefaultPaddingFactory)
+	cli = NewClientSession(c1, &padding.DefaultPaddingFactory)
+	limit(cli, srv)
+	go srv.Run()
+	cli.Run()
+	t.Cleanup(func() {
+		cli.Close()
+		srv.Close()
+	})
+	return
+}
+
+// discard is an onNewStream that reads everything and reports when the stream ends
+func discard(done chan<- time.Time) func(*Stream) {
+	return func(s *Stream) {
+		io.Copy(io.Discard, s)
+		done <- time.Now()
+		s.Close()
+	}
+}
+
+// expectRate checks that size bytes took about as long as the limiter allows after its burst
+func expectRate(t *testing.T, size int, elapsed time.Duration) {
+	t.Helper()
+	want := time.Duration(float64(size-testBurst) / testRate * float64(time.Second))
+	if elapsed < want*8/10 || elapsed > want*2+500*time.Millisecond {
+		t.Fatal("took", elapsed, "want about", want)
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := NewRateLimiter(testRate, testBurst)
+	if wait := l.reserve(testBurst); wait != 0 {
+		t.Fatal("burst waits", wait)
+	}
+	// going into debt, the wait is how long the debt takes to pay off
+	wait := l.reserve(testRate / 2)
+	if wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Fatal("wait", wait)
+	}
+	l.refund(testRate / 2)
+	if wait = l.reserve(1); wait > 10*time.Millisecond {
+		t.Fatal("wait after refund", wait)
+	}
+	// refunds never fill the bucket beyond its burst
+	l.refund(10 * testBurst)
+	if got := tokens(l); got > testBurst {
+		t.Fatal("tokens", got)
+	}
+
+	// lowering the burst drops the tokens above it, a rate <= 0 does not limit
+	l.SetLimit(testRate/2, 0)
+	if got := tokens(l); got > testRate/2 || l.Limit() != testRate/2 {
+		t.Fatal("tokens", got, "limit", l.Limit())
+	}
+	l.SetLimit(0, 0)
+	if wait = l.reserve(100 * testRate); wait != 0 {
+		t.Fatal("unlimited waits", wait)
+	}
+}
+
+func TestRateLimitedStream(t *testing.T) {
+	const size = 512 << 10
+	for _, c := range []struct {
+		name  string
+		limit func(l *RateLimiter, cli, srv *Session)
+	}{
+		{"send", func(l *RateLimiter, cli, srv *Session) { cli.AddRateLimiter(l, nil) }},
+		{"receive", func(l *RateLimiter, cli, srv *Session) { srv.AddRateLimiter(nil, l) }},
+		{"slowest wins", func(l *RateLimiter, cli, srv *Session) {
+			cli.AddRateLimiter(NewRateLimiter(10*testRate, 0), nil)
+			cli.AddRateLimiter(l, nil)
+		}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			done := make(chan time.Time, 1)
+			cli, _ := pairLimitedSessions(t, discard(done), func(cli, srv *Session) {
+				c.limit(NewRateLimiter(testRate, testBurst), cli, srv)
+			})
+			stream, _ := cli.OpenStream()
+			start := time.Now()
+			if _, err := stream.Write(make([]byte, size)); err != nil {
+				t.Fatal(err)
+			}
+			stream.Close()
+			expectRate(t, size, (<-done).Sub(start))
+		})
+	}
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	const size = 256 << 10
+	// two sessions of the same user share the limit
+	l := NewRateLimiter(testRate, testBurst)
+	done := make(chan time.Time, 2)
+	var streams []*Stream
+	for range 2 {
+		cli, _ := pairLimitedSessions(t, discard(done), func(cli, srv *Session) { cli.AddRateLimiter(l, nil) })
+		stream, _ := cli.OpenStream()
+		streams = append(streams, stream)
+	}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, stream := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream.Write(make([]byte, size))
+			stream.Close()
+		}()
+	}
+	wg.Wait()
+	<-done
+	expectRate(t, 2*size, (<-done).Sub(start))
+}
+
+func TestWaitRateDeadline(t *testing.T) {
+	l := NewRateLimiter(testRate/8, testBurst)
+	cli, _ := pairLimitedSessions(t, func(s *Stream) { io.Copy(io.Discard, s) }, func(cli, srv *Session) {
+		cli.AddRateLimiter(l, nil)
+	})
+	stream, _ := cli.OpenStream()
+	stream.Write([]byte{0})
+	waitSettingsKnown(t, cli)
+
+	// the writer is held back by the limiter until its deadline
+	stream.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := stream.Write(make([]byte, testRate))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n >= testRate/8 {
+		t.Fatal(n, err)
+	}
+	// the chunk that was given up is neither charged to the limiter nor to the window
+	if got := tokens(l); got < -1 {
+		t.Fatal("limiter left in debt", got)
+	}
+	if w := sendWindow(stream); w != defaultStreamWindow-int64(n)-1 {
+		t.Fatal("window", w, "written", n+1)
+	}
+}
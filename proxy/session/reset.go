@@ -0,0 +1,106 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/sagernet/sing/common"
+)
+
+// Error codes carried by cmdRST
+const (
+	ResetCancel            uint32 = 0 // the stream was aborted for no specific reason
+	ResetConnectionReset   uint32 = 1 // the proxied TCP connection was reset
+	ResetConnectionRefused uint32 = 2 // the proxied TCP connection was refused
+	ResetInternalError     uint32 = 3 // the sender hit a local error
+)
+
+// ResetError is returned by Read and Write of a stream aborted by cmdRST
+type ResetError struct {
+	Code   uint32
+	Remote bool
+}
+
+func (e *ResetError) Error() string {
+	side := "local"
+	if e.Remote {
+		side = "remote"
+	}
+	switch e.Code {
+	case ResetCancel:
+		return side + ": stream reset"
+	case ResetConnectionReset:
+		return side + ": stream reset: connection reset"
+	case ResetConnectionRefused:
+		return side + ": stream reset: connection refused"
+	case ResetInternalError:
+		return side + ": stream reset: internal error"
+	default:
+		return fmt.Sprintf("%s: stream reset: code %d", side, e.Code)
+	}
+}
+
+// IsReset reports whether err was caused by an aborted stream
+func IsReset(err error) bool {
+	var resetErr *ResetError
+	return errors.As(err, &resetErr)
+}
+
+// ResetCodeOf maps an error of a proxied connection to a cmdRST code
+func ResetCodeOf(err error) (uint32, bool) {
+	switch {
+	case errors.Is(err, syscall.ECONNRESET):
+		return ResetConnectionReset, true
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ResetConnectionRefused, true
+	}
+	return 0, false
+}
+
+// resettable is a stream NewResetConn can abort, a *Stream or a *ClientStream
+type resettable interface {
+	Reset(code uint32) error
+	closeError() error
+}
+
+// NewResetConn ties the abortive close of a TCP connection to a stream relayed with it:
+// a reset of conn resets the stream, and closing conn after the stream was reset sends a TCP RST.
+func NewResetConn(conn net.Conn, stream resettable) net.Conn {
+	return &resetConn{Conn: conn, stream: stream}
+}
+
+type resetConn struct {
+	net.Conn
+	stream resettable
+}
+
+func (c *resetConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if code, ok := ResetCodeOf(err); ok {
+		c.stream.Reset(code)
+	}
+	return n, err
+}
+
+func (c *resetConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if code, ok := ResetCodeOf(err); ok {
+		c.stream.Reset(code)
+	}
+	return n, err
+}
+
+func (c *resetConn) Close() error {
+	if IsReset(c.stream.closeError()) {
+		if tcpConn, ok := common.Cast[*net.TCPConn](c.Conn); ok {
+			tcpConn.SetLinger(0)
+		}
+	}
+	return c.Conn.Close()
+}
+
+func (c *resetConn) Upstream() any {
+	return c.Conn
+}
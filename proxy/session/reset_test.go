@@ -0,0 +1,136 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/bufio"
+)
+
+func TestReset(t *testing.T) {
+	serverErr := make(chan error, 1)
+	cli, _ := pairSessions(t, func(s *Stream) {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(s, b); err != nil {
+			serverErr <- err
+			return
+		}
+		if b[0] == 'r' {
+			s.Write([]byte("discarded"))
+			s.Reset(ResetConnectionRefused)
+			return
+		}
+		_, err := io.Copy(io.Discard, s)
+		serverErr <- err
+	})
+
+	// reset by the server
+	stream, _ := cli.OpenStream()
+	stream.Write([]byte("r"))
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.ReadAll(stream)
+	var resetErr *ResetError
+	if !errors.As(err, &resetErr) || resetErr.Code != ResetConnectionRefused || !resetErr.Remote {
+		t.Fatal("client read", err)
+	}
+	if _, err := stream.Write([]byte("x")); !IsReset(err) {
+		t.Fatal("client write", err)
+	}
+
+	// reset by the client
+	stream, _ = cli.OpenStream()
+	stream.Write([]byte("c"))
+	if err := stream.Reset(ResetCancel); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-serverErr; !errors.As(err, &resetErr) || resetErr.Code != ResetCancel || !resetErr.Remote {
+		t.Fatal("server read", err)
+	}
+	if _, err := stream.Read(make([]byte, 1)); !errors.As(err, &resetErr) || resetErr.Remote {
+		t.Fatal("client read after local reset", err)
+	}
+}
+
+func TestResetBeforeSettings(t *testing.T) {
+	serverErr := make(chan error, 1)
+	cli, _ := pairSlowSessions(t, func(s *Stream) {
+		_, err := io.Copy(io.Discard, s)
+		serverErr <- err
+	}, 200*time.Millisecond)
+	stream, _ := cli.OpenStream()
+	stream.Write([]byte("c"))
+	// the server must see an abort, not a clean end of the request
+	if err := stream.Reset(ResetCancel); err != nil {
+		t.Fatal(err)
+	}
+	var resetErr *ResetError
+	select {
+	case err := <-serverErr:
+		if !errors.As(err, &resetErr) || resetErr.Code != ResetCancel {
+			t.Fatal("server read", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server not reset")
+	}
+}
+
+func TestResetConn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		conn.Read(make([]byte, 1))
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}()
+	cli, _ := pairSessions(t, func(s *Stream) {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			s.Close()
+			return
+		}
+		bufio.CopyConn(context.Background(), s, NewResetConn(conn, s))
+	})
+	stream, _ := cli.OpenStream()
+	stream.Write([]byte("x"))
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadAll(stream)
+	var resetErr *ResetError
+	if !errors.As(err, &resetErr) || resetErr.Code != ResetConnectionReset {
+		t.Fatal("client read", err)
+	}
+}
+
+func TestResetOldServer(t *testing.T) {
+	frames := make(chan byte, 8)
+	cli := pairOldServer(t, func(p *oldPeer, hdr rawHeader, data []byte) error {
+		frames <- hdr.Cmd()
+		return nil
+	}, 0)
+	stream, _ := cli.OpenStream()
+	stream.Write([]byte("x"))
+	waitSettingsKnown(t, cli)
+	stream.Reset(ResetCancel)
+	// a version 2 server does not know cmdRST, the stream is closed instead
+	for cmd := range frames {
+		if cmd == cmdRST {
+			t.Fatal("cmdRST sent to an old server")
+		}
+		if cmd == cmdFIN {
+			break
+		}
+	}
+	if _, err := stream.Read(make([]byte, 1)); err == nil || IsReset(err) {
+		t.Fatal("read", err)
+	}
+}
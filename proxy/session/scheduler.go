@@ -0,0 +1,200 @@
+package session
+
+import (
+	"io"
+	"slices"
+	"sync"
+
+	"github.com/sagernet/sing/common/buf"
+)
+
+// Stream priorities, a stream gets a share of the connection proportional to its priority
+const (
+	PriorityLow    = 1
+	PriorityNormal = 4
+	PriorityHigh   = 16
+)
+
+// schedulerQuantum is the number of bytes a stream of priority 1 may send per round
+const schedulerQuantum = 4 * 1024
+
+type writeRequest struct {
+	buffer   *buf.Buffer
+	sid      uint32
+	priority int
+	control  bool
+	datagram bool
+	done     chan error // nil for datagrams, nobody waits for them
+}
+
+// fail releases a request that will never be written
+func (req *writeRequest) fail(err error) {
+	req.buffer.Release()
+	if req.done != nil {
+		req.done <- err
+	}
+}
+
+type streamQueue struct {
+	sid      uint32
+	priority int
+	deficit  int
+	granted  bool
+	pending  []*writeRequest
+	// datagramBytes is how much of pending is datagrams
+	datagramBytes int
+}
+
+// writeScheduler orders frames waiting for the connection:
+// control frames always go first, data frames are interleaved between streams by deficit round robin.
+type writeScheduler struct {
+	lock    sync.Mutex
+	notify  chan struct{}
+	control []*writeRequest
+	queues  map[uint32]*streamQueue
+	active  []*streamQueue
+	cur     int
+	closed  bool
+}
+
+func newWriteScheduler() *writeScheduler {
+	return &writeScheduler{
+		notify: make(chan struct{}, 1),
+		queues: make(map[uint32]*streamQueue),
+	}
+}
+
+func (w *writeScheduler) push(req *writeRequest) {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		req.fail(io.ErrClosedPipe)
+		return
+	}
+	if req.control {
+		w.control = append(w.control, req)
+	} else {
+		q, ok := w.queues[req.sid]
+		if !ok {
+			q = &streamQueue{sid: req.sid, priority: PriorityNormal}
+			w.queues[req.sid] = q
+			w.active = append(w.active, q)
+		}
+		if req.priority > 0 {
+			// frames closing the stream keep its priority
+			q.priority = req.priority
+		}
+		q.pending = append(q.pending, req)
+	}
+	w.lock.Unlock()
+	notify(w.notify)
+}
+
+// pushDatagram queues a datagram behind the data of its flow,
+// or refuses it if the flow already has too many datagram bytes waiting
+func (w *writeScheduler) pushDatagram(req *writeRequest) bool {
+	req.datagram = true
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return false
+	}
+	q, ok := w.queues[req.sid]
+	if ok && q.datagramBytes+req.buffer.Len() > maxQueuedDatagramBytes {
+		w.lock.Unlock()
+		return false
+	}
+	if !ok {
+		q = &streamQueue{sid: req.sid, priority: PriorityNormal}
+		w.queues[req.sid] = q
+		w.active = append(w.active, q)
+	}
+	q.priority = max(req.priority, 1)
+	q.pending = append(q.pending, req)
+	q.datagramBytes += req.buffer.Len()
+	w.lock.Unlock()
+	notify(w.notify)
+	return true
+}
+
+// pop returns the next frame to write, or nil if nothing is waiting
+func (w *writeScheduler) pop() *writeRequest {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if len(w.control) > 0 {
+		req := w.control[0]
+		w.control[0] = nil
+		w.control = w.control[1:]
+		return req
+	}
+
+	for len(w.active) > 0 {
+		if w.cur >= len(w.active) {
+			w.cur = 0
+		}
+		q := w.active[w.cur]
+		req := q.pending[0]
+		if q.deficit < req.buffer.Len() {
+			if !q.granted {
+				// the turn just moved to this stream
+				q.deficit += schedulerQuantum * q.priority
+				q.granted = true
+				continue
+			}
+			q.granted = false
+			w.cur++
+			continue
+		}
+		q.deficit -= req.buffer.Len()
+		if req.datagram {
+			q.datagramBytes -= req.buffer.Len()
+		}
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		if len(q.pending) == 0 {
+			delete(w.queues, q.sid)
+			w.active = append(w.active[:w.cur], w.active[w.cur+1:]...)
+		}
+		return req
+	}
+	return nil
+}
+
+// discard releases the frames a stream still has waiting
+func (w *writeScheduler) discard(sid uint32) {
+	w.lock.Lock()
+	q, ok := w.queues[sid]
+	if ok {
+		delete(w.queues, sid)
+		i := slices.Index(w.active, q)
+		w.active = slices.Delete(w.active, i, i+1)
+		if w.cur > i {
+			w.cur--
+		}
+	}
+	w.lock.Unlock()
+	if ok {
+		for _, req := range q.pending {
+			req.fail(io.ErrClosedPipe)
+		}
+	}
+}
+
+// close releases the frames still waiting and refuses new ones, their writers get io.ErrClosedPipe
+func (w *writeScheduler) close() {
+	w.lock.Lock()
+	w.closed = true
+	pending := w.control
+	for _, q := range w.active {
+		pending = append(pending, q.pending...)
+	}
+	w.control = nil
+	w.queues = make(map[uint32]*streamQueue)
+	w.active = nil
+	w.lock.Unlock()
+
+	for _, req := range pending {
+		req.fail(io.ErrClosedPipe)
+	}
+}
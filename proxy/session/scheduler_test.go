@@ -0,0 +1,125 @@
+package session
+
+import (
+	"anytls/proxy/padding"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+)
+
+// throttledConn writes at most rate bytes per second
+type throttledConn struct {
+	net.Conn
+	rate int
+}
+
+func (c *throttledConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Duration(len(b)) * time.Second / time.Duration(c.rate))
+	return c.Conn.Write(b)
+}
+
+// countingWriter counts what is written to it
+type countingWriter struct {
+	n atomic.Int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.n.Add(int64(len(b)))
+	return len(b), nil
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	priorities := []int{PriorityLow, PriorityNormal, PriorityHigh}
+	var lock sync.Mutex
+	received := make(map[uint32]*countingWriter)
+	for sid := range len(priorities) {
+		received[uint32(sid+1)] = new(countingWriter)
+	}
+	c1, c2 := net.Pipe()
+	srv := NewServerSession(c2, func(s *Stream) {
+		lock.Lock()
+		w := received[s.id]
+		lock.Unlock()
+		io.Copy(w, s)
+	}, &padding.DefaultPaddingFactory)
+	cli := NewClientSession(&throttledConn{Conn: c1, rate: 8 << 20}, &padding.DefaultPaddingFactory)
+	go srv.Run()
+	cli.Run()
+	t.Cleanup(func() {
+		cli.Close()
+		srv.Close()
+	})
+
+	payload := make([]byte, 32*1024)
+	for _, priority := range priorities {
+		stream, err := cli.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream.SetPriority(priority)
+		go func() {
+			for {
+				if _, err := stream.Write(payload); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	// measure once every stream is sending
+	time.Sleep(200 * time.Millisecond)
+	before := make([]int64, len(priorities))
+	for i := range priorities {
+		before[i] = received[uint32(i+1)].n.Load()
+	}
+	time.Sleep(time.Second)
+	got := make([]float64, len(priorities))
+	for i := range priorities {
+		got[i] = float64(received[uint32(i+1)].n.Load() - before[i])
+	}
+	t.Log("low, normal, high:", got)
+	for i := 1; i < len(priorities); i++ {
+		// the share follows the priority, 4 times per step
+		if ratio := got[i] / got[i-1]; ratio < 2.5 || ratio > 6 {
+			t.Fatal("priority", priorities[i], "got", ratio, "times the bytes of priority", priorities[i-1])
+		}
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	w := newWriteScheduler()
+	queued := []*writeRequest{
+		{buffer: buf.New(), control: true, done: make(chan error, 1)},
+		{buffer: buf.New(), sid: 1, done: make(chan error, 1)},
+		{buffer: buf.New(), sid: 2, done: make(chan error, 1)},
+	}
+	for _, req := range queued {
+		w.push(req)
+	}
+	w.close()
+	for _, req := range queued {
+		if err := <-req.done; err != io.ErrClosedPipe {
+			t.Fatal("queued request got", err)
+		}
+	}
+	if req := w.pop(); req != nil {
+		t.Fatal("request left after close")
+	}
+
+	late := &writeRequest{buffer: buf.New(), sid: 1, done: make(chan error, 1)}
+	w.push(late)
+	if err := <-late.done; err != io.ErrClosedPipe {
+		t.Fatal("request pushed after close got", err)
+	}
+	if w.pushDatagram(&writeRequest{buffer: buf.New(), sid: 1}) {
+		t.Fatal("datagram accepted after close")
+	}
+	if w.pop() != nil {
+		t.Fatal("request queued after close")
+	}
+}
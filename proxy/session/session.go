@@ -5,6 +5,7 @@ import (
 	"anytls/util"
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -22,9 +23,13 @@ import (
 
 var clientDebugPaddingScheme = os.Getenv("CLIENT_DEBUG_PADDING_SCHEME") == "1"
 
+// ErrGoAway is returned by OpenStream on a session that no longer accepts new streams
+var ErrGoAway = errors.New("session is going away")
+
 type Session struct {
-	conn     net.Conn
-	connLock sync.Mutex
+	conn      net.Conn
+	connLock  sync.Mutex
+	scheduler *writeScheduler
 
 	streams    map[uint32]*Stream
 	streamId   atomic.Uint32
@@ -40,9 +45,48 @@ type Session struct {
 	// pool
 	seq       uint64
 	idleSince time.Time
+	idleStart time.Time // unlike idleSince, not refreshed by idleCleanup
 	padding   *atomic.TypedValue[*padding.PaddingFactory]
 
-	peerVersion byte
+	// negotiated extensions
+	features atomic.Uint32
+
+	// flow control, initial window the peer granted to each stream
+	peerStreamWindow atomic.Uint32
+
+	// no new streams, the session is closed once the last stream is gone
+	draining atomic.Bool
+	onDrain  func()
+
+	// closed once the peer's settings are known
+	settingsDone chan struct{}
+	settingsOnce sync.Once
+
+	datagramsDropped atomic.Uint64
+
+	// client, called after the server pushed a new padding scheme
+	onPaddingUpdate func(p *padding.PaddingFactory)
+
+	// payload bytes of all streams
+	bytesSent      atomic.Uint64
+	bytesReceived  atomic.Uint64
+	trafficCounter *TrafficCounter
+
+	// token buckets the streams wait for, see AddRateLimiter
+	sendLimiters    []*RateLimiter
+	receiveLimiters []*RateLimiter
+
+	// largest cmdPSH payload, the smaller of ours and the peer's is used
+	maxFrameSize     int
+	peerMaxFrameSize atomic.Uint32
+
+	// keepalive
+	heartbeat     HeartbeatConfig
+	lastRecv      atomic.Int64
+	rtt           atomic.Int64
+	heartLock     sync.Mutex
+	heartSeq      uint32
+	heartInflight map[uint32]*heartRequest
 
 	// client
 	isClient    bool
@@ -51,6 +95,12 @@ type Session struct {
 	buffer      []byte
 	pktCounter  atomic.Uint32
 
+	// downstream padding, the server pads its writes with serverPadding,
+	// the client compares the advertised md5 with expectServerPadding
+	serverPadding       *padding.PaddingFactory
+	expectServerPadding string
+	serverPaddingMd5    atomic.TypedValue[string]
+
 	// server
 	onNewStream func(stream *Stream)
 }
@@ -63,7 +113,10 @@ func NewClientSession(conn net.Conn, _padding *atomic.TypedValue[*padding.Paddin
 		padding:     _padding,
 	}
 	s.die = make(chan struct{})
+	s.settingsDone = make(chan struct{})
 	s.streams = make(map[uint32]*Stream)
+	s.scheduler = newWriteScheduler()
+	s.maxFrameSize = defaultMaxFrameSize
 	return s
 }
 
@@ -74,20 +127,62 @@ func NewServerSession(conn net.Conn, onNewStream func(stream *Stream), _padding
 		padding:     _padding,
 	}
 	s.die = make(chan struct{})
+	s.settingsDone = make(chan struct{})
 	s.streams = make(map[uint32]*Stream)
+	s.scheduler = newWriteScheduler()
+	s.maxFrameSize = defaultMaxFrameSize
 	return s
 }
 
+// SetServerPadding makes the server pad what it sends to the client, independently of the client's scheme.
+// It must be called before Run.
+func (s *Session) SetServerPadding(p *padding.PaddingFactory) {
+	if s.isClient {
+		return
+	}
+	s.serverPadding = p
+	s.sendPadding = p != nil
+}
+
+// ExpectServerPadding makes the client warn when the server advertises another downstream padding scheme.
+// It must be called before Run.
+func (s *Session) ExpectServerPadding(md5 string) {
+	s.expectServerPadding = md5
+}
+
+// ServerPaddingMd5 returns the md5 of the downstream padding scheme advertised by the server, empty if it does not pad
+func (s *Session) ServerPaddingMd5() string {
+	return s.serverPaddingMd5.Load()
+}
+
+// SetMaxFrameSize sets the largest cmdPSH payload this side sends and wants to receive.
+// It must be called before Run.
+func (s *Session) SetMaxFrameSize(size int) {
+	if size <= 0 {
+		size = defaultMaxFrameSize
+	}
+	s.maxFrameSize = min(max(size, minFrameSize), maxFrameSize)
+}
+
 func (s *Session) Run() {
+	s.lastRecv.Store(time.Now().UnixNano())
+	go s.sendLoop()
+	if s.heartbeat.Interval > 0 {
+		go s.heartbeatLoop()
+	}
+
 	if !s.isClient {
 		s.recvLoop()
 		return
 	}
 
 	settings := util.StringMap{
-		"v":           "2",
-		"client":      util.ProgramVersionName,
-		"padding-md5": s.padding.Load().Md5,
+		"v":              strconv.Itoa(protocolVersion),
+		"client":         util.ProgramVersionName,
+		"padding-md5":    s.padding.Load().Md5,
+		"features":       Features(supportedFeatures).String(),
+		"stream-window":  strconv.Itoa(defaultStreamWindow),
+		"max-frame-size": strconv.Itoa(s.maxFrameSize),
 	}
 	f := newFrame(cmdSettings, 0)
 	f.data = settings.ToBytes()
@@ -119,6 +214,7 @@ func (s *Session) Close() error {
 			s.dieHook()
 			s.dieHook = nil
 		}
+		s.scheduler.close()
 		s.streamLock.Lock()
 		for _, stream := range s.streams {
 			stream.closeLocally()
@@ -136,13 +232,15 @@ func (s *Session) OpenStream() (*Stream, error) {
 	if s.IsClosed() {
 		return nil, io.ErrClosedPipe
 	}
+	if s.IsDraining() {
+		return nil, ErrGoAway
+	}
 
 	sid := s.streamId.Add(1)
-	stream := newStream(sid, s)
 
 	//logrus.Debugln("stream open", sid, s.streams)
 
-	if sid >= 2 && s.peerVersion >= 2 {
+	if sid >= 2 && s.Features().Has(FeatureSynAck) {
 		s.synDoneLock.Lock()
 		if s.synDone != nil {
 			s.synDone()
@@ -153,21 +251,28 @@ func (s *Session) OpenStream() (*Stream, error) {
 		s.synDoneLock.Unlock()
 	}
 
-	if _, err := s.writeControlFrame(newFrame(cmdSYN, sid)); err != nil {
-		return nil, err
-	}
-
-	s.buffering = false // proxy Write it's SocksAddr to flush the buffer
-
 	s.streamLock.Lock()
-	defer s.streamLock.Unlock()
 	select {
 	case <-s.die:
+		s.streamLock.Unlock()
 		return nil, io.ErrClosedPipe
 	default:
-		s.streams[sid] = stream
-		return stream, nil
 	}
+	// registered before the SYN goes out, as the server may answer it right away;
+	// created under streamLock so that a concurrent cmdServerSettings adjusts its window
+	stream := newStream(sid, s)
+	s.streams[sid] = stream
+	s.streamLock.Unlock()
+
+	if _, err := s.writeControlFrame(newFrame(cmdSYN, sid)); err != nil {
+		s.removeStream(sid)
+		return nil, err
+	}
+
+	s.connLock.Lock()
+	s.buffering = false // proxy Write it's SocksAddr to flush the buffer
+	s.connLock.Unlock()
+	return stream, nil
 }
 
 func (s *Session) recvLoop() error {
@@ -187,8 +292,17 @@ func (s *Session) recvLoop() error {
 		}
 		// read header first
 		if _, err := io.ReadFull(s.conn, hdr[:]); err == nil {
+			s.lastRecv.Store(time.Now().UnixNano())
 			sid := hdr.StreamID()
 			switch hdr.Cmd() {
+			case cmdWaste, cmdUpdatePaddingScheme, cmdServerSettings:
+			default:
+				// a server that sends anything else first has no cmdServerSettings
+				if s.isClient {
+					s.settingsKnown()
+				}
+			}
+			switch hdr.Cmd() {
 			case cmdPSH:
 				if hdr.Length() > 0 {
 					buffer := buf.Get(int(hdr.Length()))
@@ -197,7 +311,8 @@ func (s *Session) recvLoop() error {
 						stream, ok := s.streams[sid]
 						s.streamLock.RUnlock()
 						if ok {
-							stream.pipeW.Write(buffer)
+							stream.countReceived(len(buffer))
+							stream.pushData(buffer)
 						}
 						buf.Put(buffer)
 					} else {
@@ -248,14 +363,48 @@ func (s *Session) recvLoop() error {
 					buf.Put(buffer)
 				}
 			case cmdFIN:
-				s.streamLock.Lock()
-				stream, ok := s.streams[sid]
-				delete(s.streams, sid)
-				s.streamLock.Unlock()
+				stream, ok := s.removeStream(sid)
 				if ok {
 					stream.closeLocally()
 				}
 				//logrus.Debugln("stream fin", sid, s.streams)
+			case cmdCloseWrite:
+				s.streamLock.RLock()
+				stream, ok := s.streams[sid]
+				s.streamLock.RUnlock()
+				if ok {
+					stream.remoteCloseWrite()
+				}
+			case cmdRST:
+				var code uint32
+				if hdr.Length() > 0 {
+					buffer := buf.Get(int(hdr.Length()))
+					if _, err := io.ReadFull(s.conn, buffer); err != nil {
+						buf.Put(buffer)
+						return err
+					}
+					if len(buffer) >= 4 {
+						code = binary.BigEndian.Uint32(buffer)
+					}
+					buf.Put(buffer)
+				}
+				stream, ok := s.removeStream(sid)
+				if ok {
+					stream.abortLocally(&ResetError{Code: code, Remote: true})
+				}
+			case cmdGoAway: // should be client only
+				if hdr.Length() > 0 {
+					buffer := buf.Get(int(hdr.Length()))
+					if _, err := io.ReadFull(s.conn, buffer); err != nil {
+						buf.Put(buffer)
+						return err
+					}
+					logrus.Debugln("[GoAway from server]", string(buffer))
+					buf.Put(buffer)
+				}
+				if s.isClient {
+					s.drain()
+				}
 			case cmdWaste:
 				if hdr.Length() > 0 {
 					buffer := buf.Get(int(hdr.Length()))
@@ -275,7 +424,12 @@ func (s *Session) recvLoop() error {
 					if !s.isClient {
 						receivedSettingsFromClient = true
 						m := util.StringMapFromBytes(buffer)
+						v, _ := strconv.Atoi(m["v"])
+						features := negotiateFeatures(v, ParseFeatures(m["features"]))
 						paddingF := s.padding.Load()
+						if !features.Has(FeaturePaddingV2) {
+							paddingF = paddingF.Compatible()
+						}
 						if m["padding-md5"] != paddingF.Md5 {
 							// logrus.Debugln("remote md5 is", m["padding-md5"])
 							f := newFrame(cmdUpdatePaddingScheme, 0)
@@ -286,14 +440,28 @@ func (s *Session) recvLoop() error {
 								return err
 							}
 						}
+						s.storePeerMaxFrameSize(m)
 						// check client's version
-						if v, err := strconv.Atoi(m["v"]); err == nil && v >= 2 {
-							s.peerVersion = byte(v)
+						if v >= 2 {
+							serverSettings := util.StringMap{
+								"v":              strconv.Itoa(protocolVersion),
+								"max-frame-size": strconv.Itoa(s.maxFrameSize),
+							}
+							if w, err := strconv.ParseUint(m["stream-window"], 10, 32); err == nil && w > 0 && features.Has(FeatureFlowControl) {
+								s.peerStreamWindow.Store(uint32(w))
+								serverSettings["stream-window"] = strconv.Itoa(defaultStreamWindow)
+							} else {
+								features &^= Features(FeatureFlowControl)
+							}
+							s.features.Store(uint32(features))
+							s.settingsKnown()
+							serverSettings["features"] = features.String()
+							if s.serverPadding != nil {
+								serverSettings["server-padding-md5"] = s.serverPadding.Md5
+							}
 							// send cmdServerSettings
 							f := newFrame(cmdServerSettings, 0)
-							f.data = util.StringMap{
-								"v": "2",
-							}.ToBytes()
+							f.data = serverSettings.ToBytes()
 							_, err = s.writeControlFrame(f)
 							if err != nil {
 								buf.Put(buffer)
@@ -324,7 +492,12 @@ func (s *Session) recvLoop() error {
 						return err
 					}
 					if s.isClient && !clientDebugPaddingScheme {
-						if padding.UpdatePaddingScheme(rawScheme) {
+						// only the Client owning this session learns the scheme
+						if p := padding.NewPaddingFactory(rawScheme); p != nil {
+							s.padding.Store(p)
+							if s.onPaddingUpdate != nil {
+								s.onPaddingUpdate(p)
+							}
 							logrus.Infof("[Update padding succeed] %x\n", md5.Sum(rawScheme))
 						} else {
 							logrus.Warnf("[Update padding failed] %x\n", md5.Sum(rawScheme))
@@ -336,8 +509,24 @@ func (s *Session) recvLoop() error {
 					return err
 				}
 			case cmdHeartResponse:
-				// Active keepalive checking is not implemented yet
-				break
+				s.onHeartResponse(sid)
+			case cmdUpdateWindow:
+				if hdr.Length() > 0 {
+					buffer := buf.Get(int(hdr.Length()))
+					if _, err := io.ReadFull(s.conn, buffer); err != nil {
+						buf.Put(buffer)
+						return err
+					}
+					if len(buffer) >= 4 {
+						s.streamLock.RLock()
+						stream, ok := s.streams[sid]
+						s.streamLock.RUnlock()
+						if ok {
+							stream.addSendWindow(int64(binary.BigEndian.Uint32(buffer)))
+						}
+					}
+					buf.Put(buffer)
+				}
 			case cmdServerSettings:
 				if hdr.Length() > 0 {
 					buffer := buf.Get(int(hdr.Length()))
@@ -348,14 +537,53 @@ func (s *Session) recvLoop() error {
 					if s.isClient {
 						// check server's version
 						m := util.StringMapFromBytes(buffer)
-						if v, err := strconv.Atoi(m["v"]); err == nil {
-							s.peerVersion = byte(v)
+						v, _ := strconv.Atoi(m["v"])
+						features := negotiateFeatures(v, ParseFeatures(m["features"]))
+						s.storePeerMaxFrameSize(m)
+						if w, err := strconv.ParseUint(m["stream-window"], 10, 32); err == nil && w > 0 && features.Has(FeatureFlowControl) {
+							// streams opened before this used the default window
+							s.streamLock.Lock()
+							s.peerStreamWindow.Store(uint32(w))
+							for _, stream := range s.streams {
+								stream.addSendWindow(int64(w) - defaultStreamWindow)
+							}
+							s.streamLock.Unlock()
+						} else {
+							features &^= Features(FeatureFlowControl)
+						}
+						s.features.Store(uint32(features))
+						s.settingsKnown()
+						s.serverPaddingMd5.Store(m["server-padding-md5"])
+						if s.expectServerPadding != "" && s.expectServerPadding != m["server-padding-md5"] {
+							logrus.Warnln("[Server padding mismatch] expected", s.expectServerPadding, "got", m["server-padding-md5"])
 						}
 					}
 					buf.Put(buffer)
 				}
+			case cmdDatagram:
+				if hdr.Length() > 0 {
+					datagram := buf.NewSize(int(hdr.Length()))
+					if _, err := datagram.ReadFullFrom(s.conn, int(hdr.Length())); err != nil {
+						datagram.Release()
+						return err
+					}
+					s.streamLock.RLock()
+					stream, ok := s.streams[sid]
+					s.streamLock.RUnlock()
+					if ok {
+						stream.countReceived(datagram.Len())
+						stream.pushDatagram(datagram)
+					} else {
+						datagram.Release()
+					}
+				}
 			default:
-				// I don't know what command it is (can't have data)
+				// I don't know what command it is, skip its data in case it is an extension
+				if hdr.Length() > 0 {
+					if _, err := io.CopyN(io.Discard, s.conn, int64(hdr.Length())); err != nil {
+						return err
+					}
+				}
 			}
 		} else {
 			return err
@@ -363,126 +591,288 @@ func (s *Session) recvLoop() error {
 	}
 }
 
-func (s *Session) streamClosed(sid uint32) error {
+// GoAway asks the client to stop opening streams on this session, for SERVER.
+// Streams in flight are finished normally, then the client closes the session.
+// A client that does not understand cmdGoAway gets its session closed as soon as it is idle.
+func (s *Session) GoAway(reason string) error {
 	if s.IsClosed() {
 		return io.ErrClosedPipe
 	}
-	_, err := s.writeControlFrame(newFrame(cmdFIN, sid))
+	if s.Features().Has(FeatureGoAway) {
+		f := newFrame(cmdGoAway, 0)
+		f.data = []byte(reason)
+		if _, err := s.writeControlFrame(f); err != nil {
+			return err
+		}
+	}
+	s.drain()
+	return nil
+}
+
+// Traffic returns the stream payload bytes sent and received on this session so far
+func (s *Session) Traffic() (sent, received uint64) {
+	return s.bytesSent.Load(), s.bytesReceived.Load()
+}
+
+// IsDraining reports whether the session refuses new streams
+func (s *Session) IsDraining() bool {
+	return s.draining.Load()
+}
+
+// drain stops new streams and closes the session if it is already idle
+func (s *Session) drain() {
+	if s.draining.Swap(true) {
+		return
+	}
+	if s.onDrain != nil {
+		s.onDrain()
+	}
+	s.streamLock.RLock()
+	idle := len(s.streams) == 0
+	s.streamLock.RUnlock()
+	if idle && s.closeWhenDrained() {
+		s.Close()
+	}
+}
+
+// closeWhenDrained tells who closes a draining session: the client does,
+// the server only does it for clients that cannot be told to go away
+func (s *Session) closeWhenDrained() bool {
+	return s.draining.Load() && (s.isClient || !s.Features().Has(FeatureGoAway))
+}
+
+// removeStream forgets a finished stream, a draining session is closed after its last stream
+func (s *Session) removeStream(sid uint32) (*Stream, bool) {
 	s.streamLock.Lock()
+	stream, ok := s.streams[sid]
 	delete(s.streams, sid)
+	idle := len(s.streams) == 0
 	s.streamLock.Unlock()
+	if ok && idle && s.closeWhenDrained() {
+		go s.Close()
+	}
+	return stream, ok
+}
+
+func (s *Session) streamClosed(sid uint32) error {
+	if s.IsClosed() {
+		return io.ErrClosedPipe
+	}
+	// behind the data still queued for the stream
+	err := s.writeFrame(&writeRequest{buffer: encodeFrame(newFrame(cmdFIN, sid)), sid: sid})
+	s.removeStream(sid)
 	return err
 }
 
-func (s *Session) writeDataFrame(sid uint32, data []byte) (int, error) {
-	dataLen := len(data)
+// settingsKnown marks the peer's settings as received, or as never coming
+func (s *Session) settingsKnown() {
+	s.settingsOnce.Do(func() {
+		close(s.settingsDone)
+	})
+}
 
-	buffer := buf.NewSize(dataLen + headerOverHeadSize)
-	buffer.WriteByte(cmdPSH)
-	binary.BigEndian.PutUint32(buffer.Extend(4), sid)
-	binary.BigEndian.PutUint16(buffer.Extend(2), uint16(dataLen))
-	buffer.Write(data)
-	_, err := s.writeConn(buffer.Bytes())
-	buffer.Release()
+// Features returns the extensions negotiated with the peer, empty until settings were exchanged
+func (s *Session) Features() Features {
+	return Features(s.features.Load())
+}
+
+// windowKnown reports whether the stream windows of the peer are known:
+// a server learns them before it accepts any stream, a client once the server settings arrived
+func (s *Session) windowKnown() bool {
+	if !s.isClient {
+		return true
+	}
+	select {
+	case <-s.settingsDone:
+		return true
+	default:
+		return false
+	}
+}
+
+// flowControl reports whether both sides agreed on per-stream receive windows
+func (s *Session) flowControl() bool {
+	return s.Features().Has(FeatureFlowControl)
+}
+
+// initialSendWindow is the window a new stream may send before the peer grants more
+func (s *Session) initialSendWindow() uint32 {
+	if w := s.peerStreamWindow.Load(); w > 0 {
+		return w
+	}
+	return defaultStreamWindow
+}
+
+// framePayloadSize is the largest cmdPSH payload we may send
+func (s *Session) framePayloadSize() int {
+	if peer := int(s.peerMaxFrameSize.Load()); peer > 0 {
+		return min(s.maxFrameSize, peer)
+	}
+	return s.maxFrameSize
+}
+
+func (s *Session) storePeerMaxFrameSize(m util.StringMap) {
+	if size, err := strconv.Atoi(m["max-frame-size"]); err == nil && size > 0 {
+		s.peerMaxFrameSize.Store(uint32(min(max(size, minFrameSize), maxFrameSize)))
+	}
+}
+
+func (s *Session) writeWindowUpdate(sid uint32, n uint32) error {
+	f := newFrame(cmdUpdateWindow, sid)
+	f.data = binary.BigEndian.AppendUint32(nil, n)
+	_, err := s.writeControlFrame(f)
+	return err
+}
+
+func (s *Session) streamReset(sid uint32, code uint32) error {
+	if s.IsClosed() {
+		return io.ErrClosedPipe
+	}
+	// what the stream queued is of no use to the peer anymore
+	s.scheduler.discard(sid)
+	f := newFrame(cmdRST, sid)
+	f.data = binary.BigEndian.AppendUint32(nil, code)
+	_, err := s.writeControlFrame(f)
+	s.removeStream(sid)
+	return err
+}
+
+// queueDataFrame queues a cmdPSH behind the stream's earlier frames without waiting for it to be written,
+// so that a busy stream always has frames waiting and gets its share by priority.
+// The returned request reports on done once the frame was written.
+func (s *Session) queueDataFrame(sid uint32, priority int, data []byte) *writeRequest {
+	f := newFrame(cmdPSH, sid)
+	f.data = data
+	req := &writeRequest{
+		buffer:   encodeFrame(f),
+		sid:      sid,
+		priority: priority,
+		done:     make(chan error, 1),
+	}
+	s.scheduler.push(req)
+	return req
+}
+
+func (s *Session) writeControlFrame(frame frame) (int, error) {
+	err := s.writeFrame(&writeRequest{
+		buffer:  encodeFrame(frame),
+		sid:     frame.sid,
+		control: true,
+	})
 	if err != nil {
 		return 0, err
 	}
 
-	return dataLen, nil
+	return len(frame.data), nil
 }
 
-func (s *Session) writeControlFrame(frame frame) (int, error) {
+func encodeFrame(frame frame) *buf.Buffer {
 	dataLen := len(frame.data)
-
 	buffer := buf.NewSize(dataLen + headerOverHeadSize)
 	buffer.WriteByte(frame.cmd)
 	binary.BigEndian.PutUint32(buffer.Extend(4), frame.sid)
 	binary.BigEndian.PutUint16(buffer.Extend(2), uint16(dataLen))
 	buffer.Write(frame.data)
+	return buffer
+}
 
-	s.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
-
-	_, err := s.writeConn(buffer.Bytes())
-	buffer.Release()
-	if err != nil {
-		s.Close()
-		return 0, err
+// writeFrame queues an encoded frame for sendLoop and waits until it is written.
+// The buffer belongs to the scheduler from now on.
+func (s *Session) writeFrame(req *writeRequest) error {
+	req.done = make(chan error, 1)
+	s.scheduler.push(req)
+	select {
+	case err := <-req.done:
+		return err
+	case <-s.die:
+		return io.ErrClosedPipe
 	}
+}
 
-	s.conn.SetWriteDeadline(time.Time{})
+// sendLoop is the only writer of the connection, it writes frames in the order chosen by the scheduler
+func (s *Session) sendLoop() {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorln("[BUG]", r, string(debug.Stack()))
+		}
+	}()
 
-	return dataLen, nil
+	for {
+		req := s.scheduler.pop()
+		if req == nil {
+			select {
+			case <-s.scheduler.notify:
+				continue
+			case <-s.die:
+				return
+			}
+		}
+
+		if req.control {
+			s.conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+		}
+		_, err := s.writeConn(req.buffer.Bytes())
+		if req.control && err == nil {
+			s.conn.SetWriteDeadline(time.Time{})
+		}
+		req.buffer.Release()
+		if req.done != nil {
+			req.done <- err
+		}
+		if err != nil {
+			s.Close()
+			return
+		}
+	}
 }
 
 func (s *Session) writeConn(b []byte) (n int, err error) {
 	s.connLock.Lock()
-	defer s.connLock.Unlock()
-
 	if s.buffering {
 		s.buffer = slices.Concat(s.buffer, b)
+		s.connLock.Unlock()
 		return len(b), nil
 	} else if len(s.buffer) > 0 {
 		b = slices.Concat(s.buffer, b)
 		s.buffer = nil
 	}
+	s.connLock.Unlock()
+
+	// sendLoop is the only writer, the padding state and the connection need no lock,
+	// so a delayed padding record does not hold up OpenStream or waitSettings
+	if len(b) == 0 {
+		return 0, nil
+	}
 
 	// calulate & send padding
 	if s.sendPadding {
 		pkt := s.pktCounter.Add(1)
-		paddingF := s.padding.Load()
+		paddingF := s.serverPadding
+		if s.isClient {
+			paddingF = s.padding.Load()
+		}
 		if pkt < paddingF.Stop {
-			pktSizes := paddingF.GenerateRecordPayloadSizes(pkt)
-			for _, l := range pktSizes {
-				remainPayloadLen := len(b)
-				if l == padding.CheckMark {
-					if remainPayloadLen == 0 {
-						break
-					} else {
-						continue
+			for _, w := range paddingF.SplitPacket(pkt, len(b), headerOverHeadSize) {
+				if w.Delay > 0 {
+					if err = s.sleep(w.Delay); err != nil {
+						return n, err
 					}
 				}
-				// logrus.Debugln(pkt, "write", l, "len", remainPayloadLen, "remain", remainPayloadLen-l)
-				if remainPayloadLen > l { // this packet is all payload
-					_, err = s.conn.Write(b[:l])
-					if err != nil {
-						return 0, err
-					}
-					n += l
-					b = b[l:]
-				} else if remainPayloadLen > 0 { // this packet contains padding and the last part of payload
-					paddingLen := l - remainPayloadLen - headerOverHeadSize
-					if paddingLen > 0 {
-						padding := make([]byte, headerOverHeadSize+paddingLen)
-						padding[0] = cmdWaste
-						binary.BigEndian.PutUint32(padding[1:5], 0)
-						binary.BigEndian.PutUint16(padding[5:7], uint16(paddingLen))
-						b = slices.Concat(b, padding)
-					}
-					_, err = s.conn.Write(b)
-					if err != nil {
-						return 0, err
-					}
-					n += remainPayloadLen
-					b = nil
-				} else { // this packet is all padding
-					padding := make([]byte, headerOverHeadSize+l)
+				data := b[:w.Payload]
+				if w.Padding > 0 {
+					padding := make([]byte, w.Padding)
 					padding[0] = cmdWaste
 					binary.BigEndian.PutUint32(padding[1:5], 0)
-					binary.BigEndian.PutUint16(padding[5:7], uint16(l))
-					_, err = s.conn.Write(padding)
-					if err != nil {
-						return 0, err
-					}
-					b = nil
+					binary.BigEndian.PutUint16(padding[5:7], uint16(w.Padding-headerOverHeadSize))
+					data = slices.Concat(data, padding)
 				}
+				if _, err = s.conn.Write(data); err != nil {
+					return n, err
+				}
+				n += w.Payload
+				b = b[w.Payload:]
 			}
-			// maybe still remain payload to write
-			if len(b) == 0 {
-				return
-			} else {
-				n2, err := s.conn.Write(b)
-				return n + n2, err
-			}
+			return
 		} else {
 			s.sendPadding = false
 		}
@@ -490,3 +880,15 @@ func (s *Session) writeConn(b []byte) (n int, err error) {
 
 	return s.conn.Write(b)
 }
+
+// sleep waits before a delayed padding record, it is cut short when the session dies
+func (s *Session) sleep(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-s.die:
+		return io.ErrClosedPipe
+	}
+}
@@ -0,0 +1,473 @@
+package session
+
+import (
+	"anytls/proxy/padding"
+	"anytls/util"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pairSessions connects a client and a server session over net.Pipe.
+// maxFrameSize sets the client's and the server's SetMaxFrameSize, 0 keeps the default.
+func pairSessions(t *testing.T, onNewStream func(*Stream), maxFrameSize ...int) (cli, srv *Session) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	srv = NewServerSession(c2, onNewStream, &padding.DefaultPaddingFactory)
+	cli = NewClientSession(c1, &padding.DefaultPaddingFactory)
+	if len(maxFrameSize) == 2 {
+		cli.SetMaxFrameSize(maxFrameSize[0])
+		srv.SetMaxFrameSize(maxFrameSize[1])
+	}
+	go srv.Run()
+	cli.Run()
+	t.Cleanup(func() {
+		cli.Close()
+		srv.Close()
+	})
+	return
+}
+
+// waitSettingsKnown fails the test if the peer's settings do not arrive in time
+func waitSettingsKnown(t *testing.T, s *Session) {
+	t.Helper()
+	select {
+	case <-s.settingsDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("settings not received")
+	}
+}
+
+// echo is an onNewStream that writes back everything it reads
+func echo(s *Stream) {
+	io.Copy(s, s)
+	s.Close()
+}
+
+// orDefault is the frame size SetMaxFrameSize(size) results in
+func orDefault(size int) int {
+	if size == 0 {
+		return defaultMaxFrameSize
+	}
+	return size
+}
+
+func randomPayload(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+// roundTrip writes payload to conn while reading the same amount back
+func roundTrip(t *testing.T, conn io.ReadWriter, payload []byte) {
+	t.Helper()
+	writeErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(payload)
+		writeErr <- err
+	}()
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("read:", err)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatal("write:", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload corrupted")
+	}
+}
+
+// frameWatcher parses the frames read through it and remembers the largest cmdPSH payload
+type frameWatcher struct {
+	net.Conn
+	hdr     rawHeader
+	hdrLen  int
+	skip    int
+	largest atomic.Int32
+}
+
+func (c *frameWatcher) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for p := b[:n]; len(p) > 0; {
+		if c.skip > 0 {
+			k := min(c.skip, len(p))
+			c.skip -= k
+			p = p[k:]
+			continue
+		}
+		k := copy(c.hdr[c.hdrLen:], p)
+		c.hdrLen += k
+		p = p[k:]
+		if c.hdrLen == headerOverHeadSize {
+			if l := int32(c.hdr.Length()); c.hdr.Cmd() == cmdPSH && l > c.largest.Load() {
+				c.largest.Store(l)
+			}
+			c.skip = int(c.hdr.Length())
+			c.hdrLen = 0
+		}
+	}
+	return n, err
+}
+
+// oldPeer speaks protocol version 2 by hand, like the clients and servers that predate the extensions.
+// It does not advertise features, a stream window or a max frame size.
+type oldPeer struct {
+	conn net.Conn
+}
+
+func (p *oldPeer) writeFrame(cmd byte, sid uint32, data []byte) error {
+	b := make([]byte, headerOverHeadSize, headerOverHeadSize+len(data))
+	b[0] = cmd
+	binary.BigEndian.PutUint32(b[1:], sid)
+	binary.BigEndian.PutUint16(b[5:], uint16(len(data)))
+	_, err := p.conn.Write(append(b, data...))
+	return err
+}
+
+func (p *oldPeer) readFrame() (rawHeader, []byte, error) {
+	var hdr rawHeader
+	if _, err := io.ReadFull(p.conn, hdr[:]); err != nil {
+		return hdr, nil, err
+	}
+	data := make([]byte, hdr.Length())
+	_, err := io.ReadFull(p.conn, data)
+	return hdr, data, err
+}
+
+// writeSettings sends the cmdSettings of a version 2 client
+func (p *oldPeer) writeSettings() error {
+	settings := util.StringMap{
+		"v":           "2",
+		"client":      "anytls/0.0.8",
+		"padding-md5": padding.DefaultPaddingFactory.Load().Md5,
+	}
+	return p.writeFrame(cmdSettings, 0, settings.ToBytes())
+}
+
+// pairOldClient connects a server session to an old client
+func pairOldClient(t *testing.T, onNewStream func(*Stream), maxFrameSize int) (*oldPeer, *Session) {
+	c1, c2 := net.Pipe()
+	srv := NewServerSession(c2, onNewStream, &padding.DefaultPaddingFactory)
+	srv.SetMaxFrameSize(maxFrameSize)
+	go srv.Run()
+	t.Cleanup(func() {
+		c1.Close()
+		srv.Close()
+	})
+	return &oldPeer{conn: c1}, srv
+}
+
+// pairOldServer connects a client session to an old server, serve answers the client's frames
+func pairOldServer(t *testing.T, serve func(p *oldPeer, hdr rawHeader, data []byte) error, maxFrameSize int) *Session {
+	return pairFakeServer(t, func(p *oldPeer, hdr rawHeader, data []byte) error {
+		switch hdr.Cmd() {
+		case cmdSettings:
+			return p.writeFrame(cmdServerSettings, 0, util.StringMap{"v": "2"}.ToBytes())
+		case cmdSYN:
+			return p.writeFrame(cmdSYNACK, hdr.StreamID(), nil)
+		case cmdHeartRequest:
+			return p.writeFrame(cmdHeartResponse, hdr.StreamID(), nil)
+		default:
+			return serve(p, hdr, data)
+		}
+	}, maxFrameSize)
+}
+
+// pairFakeServer connects a client session to a hand written server, serve gets every frame but padding
+func pairFakeServer(t *testing.T, serve func(p *oldPeer, hdr rawHeader, data []byte) error, maxFrameSize int) *Session {
+	c1, c2 := net.Pipe()
+	p := &oldPeer{conn: c2}
+	go func() {
+		defer c2.Close()
+		for {
+			hdr, data, err := p.readFrame()
+			if err != nil {
+				return
+			}
+			if hdr.Cmd() != cmdWaste && serve(p, hdr, data) != nil {
+				return
+			}
+		}
+	}()
+	cli := NewClientSession(c1, &padding.DefaultPaddingFactory)
+	cli.SetMaxFrameSize(maxFrameSize)
+	cli.Run()
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+func TestEchoMegabytes(t *testing.T) {
+	for _, sizes := range [][2]int{
+		{0, 0},
+		{maxFrameSize, 4096},
+		{4096, maxFrameSize},
+		{maxFrameSize, maxFrameSize},
+	} {
+		t.Run(strconv.Itoa(sizes[0])+"-"+strconv.Itoa(sizes[1]), func(t *testing.T) {
+			cli, _ := pairSessions(t, echo, sizes[0], sizes[1])
+			stream, err := cli.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			roundTrip(t, stream, randomPayload(4<<20))
+		})
+	}
+}
+
+func TestFrameSizeOnWire(t *testing.T) {
+	for _, sizes := range [][2]int{
+		{0, 0},
+		{maxFrameSize, 4096},
+		{4096, maxFrameSize},
+		{maxFrameSize, maxFrameSize},
+	} {
+		t.Run(strconv.Itoa(sizes[0])+"-"+strconv.Itoa(sizes[1]), func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			cliConn, srvConn := &frameWatcher{Conn: c1}, &frameWatcher{Conn: c2}
+			srv := NewServerSession(srvConn, echo, &padding.DefaultPaddingFactory)
+			srv.SetMaxFrameSize(sizes[1])
+			cli := NewClientSession(cliConn, &padding.DefaultPaddingFactory)
+			cli.SetMaxFrameSize(sizes[0])
+			go srv.Run()
+			cli.Run()
+			defer cli.Close()
+			defer srv.Close()
+
+			stream, err := cli.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the first frames are sent before the server has announced its size
+			stream.Write([]byte{0})
+			waitSettingsKnown(t, cli)
+			b := make([]byte, 1)
+			io.ReadFull(stream, b)
+			roundTrip(t, stream, randomPayload(1<<20))
+
+			want := min(orDefault(sizes[0]), orDefault(sizes[1]))
+			if cli.framePayloadSize() != want || srv.framePayloadSize() != want {
+				t.Fatal("frame size", cli.framePayloadSize(), srv.framePayloadSize(), "want", want)
+			}
+			if got := int(srvConn.largest.Load()); got != want {
+				t.Fatal("client sent frames of", got, "want", want)
+			}
+			// io.Copy in echo writes at most 32 KiB at a time
+			if got := int(cliConn.largest.Load()); got != min(want, 32*1024) {
+				t.Fatal("server sent frames of", got, "want", min(want, 32*1024))
+			}
+		})
+	}
+}
+
+func TestEchoOldClient(t *testing.T) {
+	p, srv := pairOldClient(t, echo, maxFrameSize)
+	payload := randomPayload(4 << 20)
+
+	go func() {
+		if p.writeSettings() != nil || p.writeFrame(cmdSYN, 1, nil) != nil {
+			return
+		}
+		for b := payload; len(b) > 0; {
+			n := min(len(b), defaultMaxFrameSize)
+			if p.writeFrame(cmdPSH, 1, b[:n]) != nil {
+				return
+			}
+			b = b[n:]
+		}
+	}()
+
+	var got []byte
+	for len(got) < len(payload) {
+		hdr, data, err := p.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Cmd() {
+		case cmdPSH:
+			if int(hdr.Length()) > srv.framePayloadSize() {
+				t.Fatal("frame of", hdr.Length(), "exceeds", srv.framePayloadSize())
+			}
+			got = append(got, data...)
+		case cmdServerSettings:
+			if m := util.StringMapFromBytes(data); m["features"] != Features(version2Features).String() {
+				t.Fatal("negotiated", m["features"], "with an old client")
+			}
+		}
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("payload corrupted")
+	}
+	if srv.flowControl() {
+		t.Fatal("flow control enabled with an old client")
+	}
+}
+
+func TestEchoOldServer(t *testing.T) {
+	var largest atomic.Int32
+	cli := pairOldServer(t, func(p *oldPeer, hdr rawHeader, data []byte) error {
+		if hdr.Cmd() != cmdPSH {
+			return nil
+		}
+		if l := int32(hdr.Length()); l > largest.Load() {
+			largest.Store(l)
+		}
+		return p.writeFrame(cmdPSH, hdr.StreamID(), data)
+	}, maxFrameSize)
+	stream, err := cli.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, stream, randomPayload(4<<20))
+	if cli.flowControl() {
+		t.Fatal("flow control enabled with an old server")
+	}
+	// an old server accepts any frame the uint16 length can describe
+	if got := int(largest.Load()); got != cli.framePayloadSize() || got != maxFrameSize {
+		t.Fatal("client sent frames of", got, "want", cli.framePayloadSize())
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	accepted := make(chan *Stream, 1)
+	cli, srv := pairSessions(t, func(s *Stream) {
+		accepted <- s
+		echo(s)
+	})
+	stream, _ := cli.OpenStream()
+	roundTrip(t, stream, []byte("before"))
+	<-accepted
+	if err := srv.GoAway("shutdown"); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !cli.IsDraining() {
+		if time.Now().After(deadline) {
+			t.Fatal("client not draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := cli.OpenStream(); err != ErrGoAway {
+		t.Fatal("open after GoAway", err)
+	}
+	// streams in flight are not affected
+	roundTrip(t, stream, []byte("after"))
+	if cli.IsClosed() || srv.IsClosed() {
+		t.Fatal("session closed with a stream in flight")
+	}
+	stream.Close()
+	select {
+	case <-srv.die:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed after its last stream")
+	}
+}
+
+func TestGoAwayOldClient(t *testing.T) {
+	accepted := make(chan *Stream, 1)
+	p, srv := pairOldClient(t, func(s *Stream) {
+		accepted <- s
+	}, 0)
+	go func() {
+		if p.writeSettings() == nil {
+			p.writeFrame(cmdSYN, 1, nil)
+		}
+	}()
+	frames := make(chan byte, 16)
+	go func() {
+		defer close(frames)
+		for {
+			hdr, _, err := p.readFrame()
+			if err != nil {
+				return
+			}
+			frames <- hdr.Cmd()
+		}
+	}()
+	stream := <-accepted
+	if err := srv.GoAway("shutdown"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.IsClosed() {
+		t.Fatal("session closed with a stream in flight")
+	}
+	// an old client cannot be told, the server closes the session once it is idle
+	stream.Close()
+	for cmd := range frames {
+		if cmd == cmdGoAway {
+			t.Fatal("cmdGoAway sent to an old client")
+		}
+	}
+	if !srv.IsClosed() {
+		t.Fatal("session not closed")
+	}
+}
+
+// writeRecorder remembers the size of every write to the connection
+type writeRecorder struct {
+	net.Conn
+	mu     sync.Mutex
+	writes []int
+}
+
+func (c *writeRecorder) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.writes = append(c.writes, len(b))
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestServerPadding(t *testing.T) {
+	serverPadding := padding.NewPaddingFactory([]byte("stop=3\n1=700-700\n2=900-900"))
+	c1, c2 := net.Pipe()
+	srvConn := &writeRecorder{Conn: c2}
+	srv := NewServerSession(srvConn, echo, &padding.DefaultPaddingFactory)
+	srv.SetServerPadding(serverPadding)
+	cli := NewClientSession(c1, &padding.DefaultPaddingFactory)
+	cli.ExpectServerPadding(serverPadding.Md5)
+	go srv.Run()
+	cli.Run()
+	defer cli.Close()
+	defer srv.Close()
+
+	stream, err := cli.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 4 {
+		roundTrip(t, stream, randomPayload(100))
+	}
+	// the client learns the md5 of the downstream scheme and drops the padding frames
+	if got := cli.ServerPaddingMd5(); got != serverPadding.Md5 {
+		t.Fatal("advertised md5", got)
+	}
+
+	// the first two packets of the server are padded to the scheme's sizes, later ones are not
+	srvConn.mu.Lock()
+	writes := slices.Clone(srvConn.writes)
+	srvConn.mu.Unlock()
+	if len(writes) < 3 || writes[0] != 700 || writes[1] != 900 {
+		t.Fatal("server writes", writes)
+	}
+	if writes[len(writes)-1] != headerOverHeadSize+100 {
+		t.Fatal("padded after stop", writes)
+	}
+
+	// without a downstream scheme the server advertises nothing
+	cli, _ = pairSessions(t, echo)
+	if stream, err = cli.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, stream, randomPayload(100))
+	if got := cli.ServerPaddingMd5(); got != "" {
+		t.Fatal("advertised md5 without a scheme", got)
+	}
+}
@@ -2,11 +2,16 @@ package session
 
 import (
 	"anytls/proxy/pipe"
+	"bytes"
+	"context"
 	"io"
 	"net"
 	"os"
 	"sync"
 	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+	"github.com/sagernet/sing/common/buf"
 )
 
 // Stream implements net.Conn
@@ -15,15 +20,41 @@ type Stream struct {
 
 	sess *Session
 
-	pipeR         *pipe.PipeReader
-	pipeW         *pipe.PipeWriter
+	recvBuf      bytes.Buffer
+	recvLock     sync.Mutex
+	recvNotify   chan struct{}
+	readNotify   chan struct{}
+	recvConsumed uint32
+	recvEOF      bool // the peer closed its write side
+	readClosed   bool
+	readDeadline pipe.PipeDeadline
+
+	priority      atomic.Int32
+	sendWindow    int64
+	sendLock      sync.Mutex
+	sendNotify    chan struct{}
 	writeDeadline pipe.PipeDeadline
+	writeClosed   atomic.Bool
 
+	// data frames handed to the scheduler and not written yet
+	queueLock   sync.Mutex
+	queued      []queuedFrame
+	queuedBytes int
+
+	die     chan struct{}
 	dieOnce sync.Once
 	dieHook func()
 	dieErr  error
 
 	reportOnce sync.Once
+
+	// payload bytes, see Traffic
+	bytesSent     atomic.Uint64
+	bytesReceived atomic.Uint64
+
+	// datagram flow, see PacketConn
+	datagrams    chan *buf.Buffer
+	datagramOnce sync.Once
 }
 
 // newStream initiates a Stream struct
@@ -31,18 +62,53 @@ func newStream(id uint32, sess *Session) *Stream {
 	s := new(Stream)
 	s.id = id
 	s.sess = sess
-	s.pipeR, s.pipeW = pipe.Pipe()
+	s.sendWindow = int64(sess.initialSendWindow())
+	s.priority.Store(PriorityNormal)
+	s.recvNotify = make(chan struct{}, 1)
+	s.readNotify = make(chan struct{}, 1)
+	s.sendNotify = make(chan struct{}, 1)
+	s.readDeadline = pipe.MakePipeDeadline()
 	s.writeDeadline = pipe.MakePipeDeadline()
+	s.die = make(chan struct{})
 	return s
 }
 
 // Read implements net.Conn
 func (s *Stream) Read(b []byte) (n int, err error) {
-	n, err = s.pipeR.Read(b)
-	if n == 0 && s.dieErr != nil {
-		err = s.dieErr
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		s.recvLock.Lock()
+		n, _ = s.recvBuf.Read(b)
+		eof := s.recvEOF || s.readClosed
+		s.recvLock.Unlock()
+		if n > 0 {
+			// the data is already taken, a deadline only cuts the wait short;
+			// until then the window is not returned, so the peer is held back as well.
+			// A cmdFIN does not end the wait, or a peer could close right after a burst to bypass the limit.
+			s.waitRate(s.sess.receiveLimiters, n, nil, s.readDeadline.Wait())
+			notify(s.readNotify)
+			s.returnWindow(n)
+			return
+		}
+		if eof {
+			return 0, io.EOF
+		}
+		select {
+		case <-s.recvNotify:
+		case <-s.die:
+			// data pushed right before a cmdFIN is still delivered
+			s.recvLock.Lock()
+			buffered := s.recvBuf.Len()
+			s.recvLock.Unlock()
+			if buffered == 0 {
+				return 0, s.dieErr
+			}
+		case <-s.readDeadline.Wait():
+			return 0, os.ErrDeadlineExceeded
+		}
 	}
-	return
 }
 
 // Write implements net.Conn
@@ -52,13 +118,270 @@ func (s *Stream) Write(b []byte) (n int, err error) {
 		return 0, os.ErrDeadlineExceeded
 	default:
 	}
-	if s.dieErr != nil {
-		return 0, s.dieErr
+	if err := s.closeError(); err != nil {
+		return 0, err
+	}
+	if s.writeClosed.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	// split into frames the peer can take
+	for once := true; once || len(b) > 0; once = false {
+		var chunk int
+		if err = s.waitQueued(); err != nil {
+			return
+		}
+		chunk, err = s.takeSendWindow(min(len(b), s.sess.framePayloadSize()))
+		if err != nil {
+			return
+		}
+		if err = s.waitRate(s.sess.sendLimiters, chunk, s.die, s.writeDeadline.Wait()); err != nil {
+			s.addSendWindow(int64(chunk))
+			return
+		}
+		s.queueData(b[:chunk])
+		n += chunk
+		s.countSent(chunk)
+		b = b[chunk:]
 	}
-	n, err = s.sess.writeDataFrame(s.id, b)
 	return
 }
 
+type queuedFrame struct {
+	done chan error
+	size int
+}
+
+// queueBudget is how many bytes a stream may have waiting in the scheduler.
+// It is more than the stream sends in one round, so a busy stream does not run dry between its turns.
+func queueBudget(priority int) int {
+	return 2 * schedulerQuantum * priority
+}
+
+// queueData hands a data frame to the scheduler, Write does not wait for it to be written
+func (s *Stream) queueData(b []byte) {
+	req := s.sess.queueDataFrame(s.id, int(s.priority.Load()), b)
+	s.queueLock.Lock()
+	s.queued = append(s.queued, queuedFrame{done: req.done, size: len(b)})
+	s.queuedBytes += len(b)
+	s.queueLock.Unlock()
+}
+
+// waitQueued blocks while the stream has more than its budget waiting in the scheduler.
+// It returns the error of a queued frame that could not be written.
+func (s *Stream) waitQueued() error {
+	s.queueLock.Lock()
+	defer s.queueLock.Unlock()
+	for {
+		// frames are written in order, forget those already done
+		for len(s.queued) > 0 {
+			select {
+			case err := <-s.queued[0].done:
+				if err = s.frameWritten(err); err != nil {
+					return err
+				}
+				continue
+			default:
+			}
+			break
+		}
+		if s.queuedBytes < queueBudget(int(s.priority.Load())) {
+			return nil
+		}
+		select {
+		case err := <-s.queued[0].done:
+			if err = s.frameWritten(err); err != nil {
+				return err
+			}
+		case <-s.sess.die:
+			return io.ErrClosedPipe
+		case <-s.writeDeadline.Wait():
+			return os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// frameWritten forgets the oldest queued frame, queueLock must be held
+func (s *Stream) frameWritten(err error) error {
+	s.queuedBytes -= s.queued[0].size
+	s.queued[0] = queuedFrame{}
+	s.queued = s.queued[1:]
+	return err
+}
+
+// SetPriority sets the share of the session this stream gets when several streams are sending,
+// see PriorityLow, PriorityNormal and PriorityHigh. Control frames are not affected.
+func (s *Stream) SetPriority(priority int) {
+	s.priority.Store(int32(max(priority, 1)))
+}
+
+// pushData is called by recvLoop with the payload of a cmdPSH.
+// When flow control is not negotiated, the peer is not bound by our window,
+// so recvLoop is held until the reader has consumed the data.
+func (s *Stream) pushData(b []byte) {
+	select {
+	case <-s.die:
+		return
+	default:
+	}
+	s.recvLock.Lock()
+	if s.readClosed {
+		// nobody will read it, but the peer still needs its window back
+		s.recvLock.Unlock()
+		s.returnWindow(len(b))
+		return
+	}
+	s.recvBuf.Write(b)
+	s.recvLock.Unlock()
+	notify(s.recvNotify)
+
+	var limit int
+	if s.sess.flowControl() {
+		limit = defaultStreamWindow
+	}
+	for {
+		s.recvLock.Lock()
+		buffered := s.recvBuf.Len()
+		s.recvLock.Unlock()
+		if buffered <= limit {
+			return
+		}
+		select {
+		case <-s.readNotify:
+		case <-s.die:
+			return
+		case <-s.sess.die:
+			return
+		}
+	}
+}
+
+// returnWindow grants consumed bytes back to the peer in batches of half a window
+func (s *Stream) returnWindow(n int) {
+	if !s.sess.flowControl() {
+		return
+	}
+	var grant uint32
+	s.recvLock.Lock()
+	s.recvConsumed += uint32(n)
+	if s.recvConsumed >= defaultStreamWindow/2 {
+		grant = s.recvConsumed
+		s.recvConsumed = 0
+	}
+	s.recvLock.Unlock()
+	if grant > 0 {
+		select {
+		case <-s.die:
+		default:
+			s.sess.writeWindowUpdate(s.id, grant)
+		}
+	}
+}
+
+// takeSendWindow blocks until some send window is available and reserves up to `want` bytes of it.
+// Until a client knows the server settings, it stays within the initial window,
+// which is what a server negotiating flow control holds the stream to.
+// Once it is known that flow control was not negotiated, writes are not held back but still accounted.
+func (s *Stream) takeSendWindow(want int) (int, error) {
+	var timeout <-chan time.Time
+	for {
+		known := s.sess.windowKnown()
+		s.sendLock.Lock()
+		if known && !s.sess.flowControl() {
+			s.sendWindow -= int64(want)
+			s.sendLock.Unlock()
+			return want, nil
+		}
+		if s.sendWindow > 0 || want == 0 {
+			n := int(min(int64(want), s.sendWindow))
+			s.sendWindow -= int64(n)
+			s.sendLock.Unlock()
+			return n, nil
+		}
+		s.sendLock.Unlock()
+		var settings <-chan struct{}
+		if !known {
+			settings = s.sess.settingsDone
+			if timeout == nil {
+				timer := time.NewTimer(settingsTimeout)
+				defer timer.Stop()
+				timeout = timer.C
+			}
+		}
+		select {
+		case <-s.sendNotify:
+		case <-settings:
+		case <-timeout:
+			// like waitSettings, a server that does not answer has no cmdServerSettings
+			s.sess.settingsKnown()
+		case <-s.die:
+			return 0, s.dieErr
+		case <-s.sess.die:
+			return 0, io.ErrClosedPipe
+		case <-s.writeDeadline.Wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// addSendWindow is called when the peer grants more window (or when the negotiated initial window differs)
+func (s *Stream) addSendWindow(delta int64) {
+	s.sendLock.Lock()
+	s.sendWindow += delta
+	s.sendLock.Unlock()
+	notify(s.sendNotify)
+}
+
+// CloseWrite sends EOF to the peer while the stream stays readable.
+// If the peer does not understand half close, the stream is fully closed instead.
+func (s *Stream) CloseWrite() error {
+	if !s.peerFeatures().Has(FeatureHalfClose) {
+		return s.Close()
+	}
+	if s.writeClosed.Swap(true) {
+		return nil
+	}
+	select {
+	case <-s.die:
+		return s.dieErr
+	default:
+	}
+	// behind the data still queued for the stream
+	return s.sess.writeFrame(&writeRequest{buffer: encodeFrame(newFrame(cmdCloseWrite, s.id)), sid: s.id})
+}
+
+// peerFeatures returns what the peer negotiated.
+// On a client session whose server settings have not arrived yet, it waits for them like OpenPacketConn,
+// a stream closed or reset before that would otherwise be treated as if the server were too old.
+func (s *Stream) peerFeatures() Features {
+	if !s.sess.isClient {
+		// the server learns the features before it accepts any stream
+		return s.sess.Features()
+	}
+	return s.sess.waitSettings(context.Background(), settingsTimeout)
+}
+
+// CloseRead discards any data received from now on, reads return EOF.
+// The peer is not notified.
+func (s *Stream) CloseRead() error {
+	s.recvLock.Lock()
+	s.readClosed = true
+	buffered := s.recvBuf.Len()
+	s.recvBuf.Reset()
+	s.recvLock.Unlock()
+	notify(s.recvNotify)
+	notify(s.readNotify)
+	s.returnWindow(buffered)
+	return nil
+}
+
+// remoteCloseWrite is called when the peer half closed the stream
+func (s *Stream) remoteCloseWrite() {
+	s.recvLock.Lock()
+	s.recvEOF = true
+	s.recvLock.Unlock()
+	notify(s.recvNotify)
+}
+
 // Close implements net.Conn
 func (s *Stream) Close() error {
 	return s.closeWithError(io.ErrClosedPipe)
@@ -69,7 +392,7 @@ func (s *Stream) closeLocally() {
 	var once bool
 	s.dieOnce.Do(func() {
 		s.dieErr = net.ErrClosed
-		s.pipeR.Close()
+		close(s.die)
 		once = true
 	})
 	if once {
@@ -80,11 +403,56 @@ func (s *Stream) closeLocally() {
 	}
 }
 
+// Reset aborts the stream: buffered data is discarded and the peer reads a *ResetError instead of EOF.
+// If the peer does not understand cmdRST, the stream is closed normally.
+func (s *Stream) Reset(code uint32) error {
+	if !s.peerFeatures().Has(FeatureReset) {
+		return s.Close()
+	}
+	if !s.abortLocally(&ResetError{Code: code}) {
+		return s.dieErr
+	}
+	return s.sess.streamReset(s.id, code)
+}
+
+// abortLocally closes the stream with err and drops what was not read yet, without notifying the peer
+func (s *Stream) abortLocally(err error) bool {
+	var once bool
+	s.dieOnce.Do(func() {
+		s.dieErr = err
+		close(s.die)
+		s.recvLock.Lock()
+		s.recvBuf.Reset()
+		s.recvLock.Unlock()
+		once = true
+	})
+	if once {
+		if s.dieHook != nil {
+			s.dieHook()
+			s.dieHook = nil
+		}
+	}
+	return once
+}
+
+// closeError returns the error the stream was closed with, or nil if it is still open
+func (s *Stream) closeError() error {
+	select {
+	case <-s.die:
+		return s.dieErr
+	default:
+		return nil
+	}
+}
+
 func (s *Stream) closeWithError(err error) error {
 	var once bool
 	s.dieOnce.Do(func() {
 		s.dieErr = err
-		s.pipeR.Close()
+		close(s.die)
+		s.recvLock.Lock()
+		s.recvBuf.Reset()
+		s.recvLock.Unlock()
 		once = true
 	})
 	if once {
@@ -99,7 +467,8 @@ func (s *Stream) closeWithError(err error) error {
 }
 
 func (s *Stream) SetReadDeadline(t time.Time) error {
-	return s.pipeR.SetReadDeadline(t)
+	s.readDeadline.Set(t)
+	return nil
 }
 
 func (s *Stream) SetWriteDeadline(t time.Time) error {
@@ -138,7 +507,7 @@ func (s *Stream) HandshakeFailure(err error) error {
 	s.reportOnce.Do(func() {
 		once = true
 	})
-	if once && err != nil && s.sess.peerVersion >= 2 {
+	if once && err != nil && s.sess.Features().Has(FeatureSynAck) {
 		f := newFrame(cmdSYNACK, s.id)
 		f.data = []byte(err.Error())
 		if _, err := s.sess.writeControlFrame(f); err != nil {
@@ -154,10 +523,17 @@ func (s *Stream) HandshakeSuccess() error {
 	s.reportOnce.Do(func() {
 		once = true
 	})
-	if once && s.sess.peerVersion >= 2 {
+	if once && s.sess.Features().Has(FeatureSynAck) {
 		if _, err := s.sess.writeControlFrame(newFrame(cmdSYNACK, s.id)); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,353 @@
+package session
+
+import (
+	"anytls/proxy/padding"
+	"anytls/util"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sendWindow returns what is left of the stream's send window
+func sendWindow(s *Stream) int64 {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	return s.sendWindow
+}
+
+// lateConn delivers what is written to it only after delay, without blocking the writer,
+// like a server whose settings take a while to arrive
+type lateConn struct {
+	net.Conn
+	delay   time.Duration
+	once    sync.Once
+	pending chan []byte
+}
+
+func (c *lateConn) Write(b []byte) (int, error) {
+	c.once.Do(func() {
+		go func() {
+			time.Sleep(c.delay)
+			for b := range c.pending {
+				if _, err := c.Conn.Write(b); err != nil {
+					return
+				}
+			}
+		}()
+	})
+	select {
+	case c.pending <- append([]byte(nil), b...):
+		return len(b), nil
+	default:
+		return 0, io.ErrShortWrite
+	}
+}
+
+// pairSlowSessions is pairSessions with the server's frames reaching the client only after delay
+func pairSlowSessions(t *testing.T, onNewStream func(*Stream), delay time.Duration) (cli, srv *Session) {
+	c1, c2 := net.Pipe()
+	srv = NewServerSession(&lateConn{Conn: c2, delay: delay, pending: make(chan []byte, 1024)}, onNewStream, &padding.DefaultPaddingFactory)
+	cli = NewClientSession(c1, &padding.DefaultPaddingFactory)
+	go srv.Run()
+	cli.Run()
+	t.Cleanup(func() {
+		cli.Close()
+		srv.Close()
+	})
+	return
+}
+
+// isClosed reports whether a read ended because the peer closed the stream
+func isClosed(err error) bool {
+	return err == nil || errors.Is(err, net.ErrClosed)
+}
+
+func TestStalledStream(t *testing.T) {
+	const size = 5 << 20
+	payload := randomPayload(size)
+	cli, _ := pairSessions(t, func(s *Stream) {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(s, b); err != nil {
+			return
+		}
+		s.Write(payload)
+		s.Close()
+	})
+	stalled, _ := cli.OpenStream()
+	stalled.Write([]byte{1})
+	waitSettingsKnown(t, cli)
+	if !cli.flowControl() {
+		t.Fatal("flow control not negotiated")
+	}
+	flowing, _ := cli.OpenStream()
+	flowing.Write([]byte{1})
+
+	// nobody reads stalled, flowing must still get everything
+	flowing.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err := io.Copy(io.Discard, flowing)
+	if !isClosed(err) || n != size {
+		t.Fatal("flowing stream got", n, err)
+	}
+	stalled.recvLock.Lock()
+	buffered := stalled.recvBuf.Len()
+	stalled.recvLock.Unlock()
+	if buffered > defaultStreamWindow {
+		t.Fatal("stalled stream buffered", buffered, "more than its window")
+	}
+	stalled.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, err = io.Copy(io.Discard, stalled)
+	if !isClosed(err) || n != size {
+		t.Fatal("stalled stream got", n, err)
+	}
+}
+
+func TestSendWindow(t *testing.T) {
+	accepted := make(chan *Stream, 1)
+	cli, _ := pairSessions(t, func(s *Stream) {
+		accepted <- s
+	})
+	stream, _ := cli.OpenStream()
+	stream.Write([]byte{1})
+	waitSettingsKnown(t, cli)
+	stream.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	n, err := stream.Write(make([]byte, 3*defaultStreamWindow))
+	if !os.IsTimeout(err) || n != defaultStreamWindow-1 {
+		t.Fatal("wrote", n, err, "to a peer that does not read")
+	}
+	if w := sendWindow(stream); w != 0 {
+		t.Fatal("window left", w)
+	}
+
+	// reading half of the window grants it back
+	peer := <-accepted
+	if _, err := io.ReadFull(peer, make([]byte, defaultStreamWindow/2)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for sendWindow(stream) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no window update")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	granted := sendWindow(stream)
+	if granted < defaultStreamWindow/2 {
+		t.Fatal("granted", granted)
+	}
+	stream.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	n, err = stream.Write(make([]byte, defaultStreamWindow))
+	if !os.IsTimeout(err) || int64(n) != granted {
+		t.Fatal("wrote", n, err, "after a window update of", granted)
+	}
+}
+
+func TestSendWindowBeforeSettings(t *testing.T) {
+	const written = 100000
+	const window = 2 * defaultStreamWindow
+
+	// a version 2 server never negotiates flow control
+	cli := pairOldServer(t, func(p *oldPeer, hdr rawHeader, data []byte) error { return nil }, 0)
+	stream, _ := cli.OpenStream()
+	if n, err := stream.Write(make([]byte, written)); err != nil || n != written {
+		t.Fatal(n, err)
+	}
+	waitSettingsKnown(t, cli)
+	if cli.flowControl() || sendWindow(stream) != defaultStreamWindow-written {
+		t.Fatal("flow control", cli.flowControl(), "window", sendWindow(stream))
+	}
+
+	// a server whose settings arrive late counts what was written before them
+	var received int
+	release := make(chan struct{})
+	cli = pairFakeServer(t, func(p *oldPeer, hdr rawHeader, data []byte) error {
+		if hdr.Cmd() != cmdPSH {
+			return nil
+		}
+		received += len(data)
+		if received < written {
+			return nil
+		}
+		<-release
+		settings := util.StringMap{
+			"v":             strconv.Itoa(protocolVersion),
+			"features":      Features(FeatureFlowControl).String(),
+			"stream-window": strconv.Itoa(window),
+		}
+		return p.writeFrame(cmdServerSettings, 0, settings.ToBytes())
+	}, 0)
+	stream, _ = cli.OpenStream()
+	// the client does not know about flow control yet, the write stays within the default window
+	if n, err := stream.Write(make([]byte, written)); err != nil || n != written {
+		t.Fatal(n, err)
+	}
+	if w := sendWindow(stream); w != defaultStreamWindow-written {
+		t.Fatal("window before settings", w)
+	}
+	close(release)
+	waitSettingsKnown(t, cli)
+	if !cli.flowControl() {
+		t.Fatal("flow control not negotiated")
+	}
+	if w := sendWindow(stream); w != window-written {
+		t.Fatal("window after settings", w, "want", window-written)
+	}
+	if w := sendWindow(newStream(99, cli)); w != window {
+		t.Fatal("window of a new stream", w)
+	}
+}
+
+func TestBurstBeforeSettings(t *testing.T) {
+	stalled := make(chan struct{})
+	defer close(stalled)
+	cli, _ := pairSlowSessions(t, func(s *Stream) {
+		defer s.Close()
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(s, b); err != nil {
+			return
+		}
+		if b[0] == 's' {
+			// a target that does not read yet
+			<-stalled
+			return
+		}
+		io.Copy(s, s)
+	}, 300*time.Millisecond)
+
+	// the burst goes out before the server settings, the server holds the stream to the default window
+	stream, _ := cli.OpenStream()
+	payload := make([]byte, 2*defaultStreamWindow)
+	payload[0] = 's'
+	stream.SetWriteDeadline(time.Now().Add(time.Second))
+	n, err := stream.Write(payload)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != defaultStreamWindow {
+		t.Fatal(n, err)
+	}
+
+	// the server still reads the session, other streams are not stalled
+	echo, _ := cli.OpenStream()
+	echo.Write([]byte("ping"))
+	b := make([]byte, 3)
+	echo.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(echo, b); err != nil || string(b) != "ing" {
+		t.Fatal(string(b), err)
+	}
+}
+
+func TestOldClientWithoutWindow(t *testing.T) {
+	const size = 3 * defaultStreamWindow
+	p, srv := pairOldClient(t, func(s *Stream) {
+		s.Write(make([]byte, size))
+		s.Close()
+	}, 0)
+	go func() {
+		if p.writeSettings() == nil {
+			p.writeFrame(cmdSYN, 1, nil)
+		}
+	}()
+	// an old client never grants window, the server must not wait for it
+	var got int
+	for {
+		hdr, data, err := p.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Cmd() == cmdPSH {
+			got += len(data)
+		}
+		if hdr.Cmd() == cmdFIN {
+			break
+		}
+	}
+	if got != size || srv.flowControl() {
+		t.Fatal("got", got, "flow control", srv.flowControl())
+	}
+}
+
+func TestHalfClose(t *testing.T) {
+	received := make(chan string, 1)
+	cli, _ := pairSessions(t, func(s *Stream) {
+		defer s.Close()
+		b, err := io.ReadAll(s)
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		received <- string(b)
+		// the write side is still open after the peer's EOF
+		s.Write([]byte("bye"))
+		s.CloseWrite()
+		io.Copy(io.Discard, s)
+	})
+	stream, _ := cli.OpenStream()
+	stream.Write([]byte("hello"))
+	waitSettingsKnown(t, cli)
+	if !cli.Features().Has(FeatureHalfClose) {
+		t.Fatal("half close not negotiated")
+	}
+	if err := stream.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("late")); err == nil {
+		t.Fatal("write after CloseWrite succeeded")
+	}
+	if got := <-received; got != "hello" {
+		t.Fatal("server read", got)
+	}
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(stream)
+	if err != nil || string(b) != "bye" {
+		t.Fatal("client read", string(b), err)
+	}
+	stream.Close()
+}
+
+func TestHalfCloseBeforeSettings(t *testing.T) {
+	cli, _ := pairSlowSessions(t, func(s *Stream) {
+		defer s.Close()
+		b, _ := io.ReadAll(s)
+		s.Write(append([]byte("re:"), b...))
+		s.CloseWrite()
+	}, 200*time.Millisecond)
+	stream, _ := cli.OpenStream()
+	stream.Write([]byte("hello"))
+	// like `nc -N`, the request is complete before the server said anything
+	if err := stream.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(stream)
+	if err != nil || string(b) != "re:hello" {
+		t.Fatal("client read", string(b), err)
+	}
+}
+
+func TestHalfCloseOldServer(t *testing.T) {
+	frames := make(chan byte, 8)
+	cli := pairOldServer(t, func(p *oldPeer, hdr rawHeader, data []byte) error {
+		frames <- hdr.Cmd()
+		return nil
+	}, 0)
+	stream, _ := cli.OpenStream()
+	stream.Write([]byte("hello"))
+	waitSettingsKnown(t, cli)
+	if err := stream.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	// a version 2 server does not know cmdCloseWrite, the stream is closed instead
+	for cmd := range frames {
+		if cmd == cmdCloseWrite {
+			t.Fatal("cmdCloseWrite sent to an old server")
+		}
+		if cmd == cmdFIN {
+			break
+		}
+	}
+	if stream.closeError() == nil {
+		t.Fatal("stream still open")
+	}
+}
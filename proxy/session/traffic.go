@@ -0,0 +1,48 @@
+package session
+
+import "github.com/sagernet/sing/common/atomic"
+
+// TrafficCounter accumulates the stream payload bytes of one or more sessions,
+// for example every session of a user. Sent and received are seen from the side owning the session.
+type TrafficCounter struct {
+	sent     atomic.Uint64
+	received atomic.Uint64
+}
+
+// Load returns the bytes counted so far
+func (c *TrafficCounter) Load() (sent, received uint64) {
+	return c.sent.Load(), c.received.Load()
+}
+
+// Store replaces the counted bytes, e.g. with values restored from disk
+func (c *TrafficCounter) Store(sent, received uint64) {
+	c.sent.Store(sent)
+	c.received.Store(received)
+}
+
+// SetTrafficCounter makes every stream of the session also count into c.
+// It must be called before Run.
+func (s *Session) SetTrafficCounter(c *TrafficCounter) {
+	s.trafficCounter = c
+}
+
+// Traffic returns the payload bytes sent and received on this stream so far
+func (s *Stream) Traffic() (sent, received uint64) {
+	return s.bytesSent.Load(), s.bytesReceived.Load()
+}
+
+func (s *Stream) countSent(n int) {
+	s.bytesSent.Add(uint64(n))
+	s.sess.bytesSent.Add(uint64(n))
+	if c := s.sess.trafficCounter; c != nil {
+		c.sent.Add(uint64(n))
+	}
+}
+
+func (s *Stream) countReceived(n int) {
+	s.bytesReceived.Add(uint64(n))
+	s.sess.bytesReceived.Add(uint64(n))
+	if c := s.sess.trafficCounter; c != nil {
+		c.received.Add(uint64(n))
+	}
+}